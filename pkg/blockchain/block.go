@@ -2,63 +2,87 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
 	"time"
 )
 
+// Block is a header together with the transactions it commits to. Hash is the
+// hash of the header.
 type Block struct {
-	Timestamp     int64
-	Transactions  []*Transaction
-	PrevBlockHash []byte
-	Hash          []byte
-	Nonce         int
+	BlockHeader
+	Transactions []*Transaction
+	Hash         []byte
 }
 
-func NewBlock(transactions []*Transaction, prevBlockHash []byte) *Block {
+// NewBlock assembles a block on top of the given parent, the block has to be
+// prepared and sealed by the consensus engine before it's valid.
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
 	block := Block{
-		Timestamp:     time.Now().Unix(),
-		Transactions:  transactions,
-		PrevBlockHash: prevBlockHash,
-		Hash:          []byte{},
-		Nonce:         0,
+		BlockHeader: BlockHeader{
+			Version:       blockVersion,
+			Height:        height,
+			PrevBlockHash: prevBlockHash,
+			Timestamp:     time.Now().Unix(),
+		},
+		Transactions: transactions,
 	}
-	pow := NewProofOfWork(&block)
-	nonce, hash := pow.Run()
-
-	block.Hash = hash[:]
-	block.Nonce = nonce
-
+	block.HashMerkleRoot = block.MerkleRoot()
 	return &block
 }
 
 func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{})
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
 }
 
 func (block *Block) Serialize() ([]byte, error) {
-	var result bytes.Buffer
-	if err := gob.NewEncoder(&result).Encode(block); err != nil {
-		return nil, err
-	}
-	return result.Bytes(), nil
+	var e encoder
+	encodeBlock(&e, block)
+	return e.buf, nil
 }
 
 func Deserialize(data []byte) (*Block, error) {
-	var block Block
-	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block); err != nil {
-		return nil, err
+	return decodeBlock(&decoder{data: data})
+}
+
+func (block *Block) merkleTree() *MerkleTree {
+	var txIDs [][]byte
+	for _, tx := range block.Transactions {
+		txIDs = append(txIDs, tx.ID)
 	}
-	return &block, nil
+	return NewMerkleTree(txIDs)
 }
 
-func (block *Block) HashTransactions() []byte {
-	var txHashes [][]byte
-	var txHash [32]byte
+// MerkleRoot computes the merkle root of the block's transactions, which a
+// valid block carries in its header as HashMerkleRoot.
+func (block *Block) MerkleRoot() []byte {
+	return block.merkleTree().Root()
+}
+
+func (block *Block) hasValidMerkleRoot() bool {
+	return bytes.Equal(block.HashMerkleRoot, block.MerkleRoot())
+}
 
+// hasDuplicateTransactions tells whether a transaction appears in the block more
+// than once. As the last node of an odd level is paired with itself, repeating
+// the last transactions doesn't change the merkle root, so such a block has to
+// be rejected rather than taken for the valid one with the same hash.
+func (block *Block) hasDuplicateTransactions() bool {
+	seen := make(map[string]bool, len(block.Transactions))
 	for _, tx := range block.Transactions {
-		txHashes = append(txHashes, tx.ID)
+		if seen[string(tx.ID)] {
+			return true
+		}
+		seen[string(tx.ID)] = true
+	}
+	return false
+}
+
+// MerkleProof returns the proof of the transaction's inclusion into the block
+// to be checked with VerifyMerkleProof against the block's merkle root.
+func (block *Block) MerkleProof(txID []byte) ([]MerkleProofStep, error) {
+	for i, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			return block.merkleTree().Proof(i)
+		}
 	}
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
-	return txHash[:]
+	return nil, ErrTransactionNotFound
 }
@@ -2,17 +2,21 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/boltdb/bolt"
+	"path/filepath"
+	"sync"
 )
 
-const (
-	dbFile              = "blockchain.db"
-	blocksBucket        = "blocks"
-	genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
-)
+const blocksBucket = "blocks"
+
+var ErrBlockNotFound = errors.New("err block not found")
+var ErrOrphanBlock = errors.New("err block's parent is unknown")
+var ErrInvalidBlock = errors.New("err invalid block")
 
 type BCIterator struct {
 	currentHash []byte
@@ -20,35 +24,91 @@ type BCIterator struct {
 }
 
 type Blockchain struct {
+	mu  sync.RWMutex
 	tip []byte
 	db  *bolt.DB
+	// consensus seals and verifies blocks and weighs the branches
+	consensus Consensus
 }
 
+// GetBlockchain opens the stored chain using the consensus engine it was
+// created with, which can verify blocks but not necessarily seal them.
 func GetBlockchain() (*Blockchain, error) {
+	return GetBlockchainWithSealer(nil, nil)
+}
+
+// GetBlockchainWithSealer opens the stored chain using the consensus engine it
+// was created with. Proof of work chains mine blocks with the miner, proof of
+// authority ones sign them with the wallet signer returns, which is only
+// called for them.
+func GetBlockchainWithSealer(miner *Miner, signer func() (*Wallet, error)) (*Blockchain, error) {
+	return openBlockchain(func(params consensusParams) (Consensus, error) {
+		var wallet *Wallet
+		if params.engine == PoAEngine && signer != nil {
+			var err error
+			if wallet, err = signer(); err != nil {
+				return nil, err
+			}
+		}
+		return params.newConsensus(miner, wallet), nil
+	})
+}
+
+// GetBlockchainWithConsensus opens the stored chain using the consensus engine,
+// which has to be the one the chain was created with.
+func GetBlockchainWithConsensus(consensus Consensus) (*Blockchain, error) {
+	return openBlockchain(func(params consensusParams) (Consensus, error) {
+		if p := paramsOf(consensus); p.engine != "" && !p.equal(params) {
+			return nil, ErrConsensusMismatch
+		}
+		return consensus, nil
+	})
+}
+
+// openBlockchain opens the stored chain with the engine built from the stored
+// consensus parameters.
+func openBlockchain(newConsensus func(params consensusParams) (Consensus, error)) (*Blockchain, error) {
 	if !dbExists() {
 		return nil, errors.New("db doesn't exist, create it first")
 	}
 
 	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(dbPath(), 0600, nil)
 	if err != nil {
 		return nil, err
 	}
+	var params consensusParams
 	err = db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-		return nil
+		tip = append([]byte{}, b.Get([]byte("l"))...)
+		params, err = getConsensusParams(tx)
+		return err
 	})
 	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	consensus, err := newConsensus(params)
+	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
-	bc := Blockchain{tip: tip, db: db}
-	return &bc, nil
+	return &Blockchain{tip: tip, db: db, consensus: consensus}, nil
 }
 
+// CreateBlockchain creates a proof of work chain, the genesis block paying to
+// the address.
 func CreateBlockchain(address string) (*Blockchain, error) {
-	var tip, serialized []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	return CreateBlockchainWithConsensus(address, NewPoWConsensus(nil))
+}
+
+func CreateBlockchainWithConsensus(address string, consensus Consensus) (*Blockchain, error) {
+	var tip []byte
+	dir, err := networkDir()
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, dbFile), 0600, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -57,200 +117,389 @@ func CreateBlockchain(address string) (*Blockchain, error) {
 			panic(err)
 		}
 	}(db)
-	var cbtx *Transaction
 	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		if b == nil {
-			cbtx, err = CreateCoinbaseTX(address, genesisCoinbaseData)
-			genesis := NewGenesisBlock(cbtx)
-			b, err = tx.CreateBucket([]byte(blocksBucket))
+		if b != nil {
+			tip = append([]byte{}, b.Get([]byte("l"))...)
+			stored, err := getConsensusParams(tx)
 			if err != nil {
 				return err
 			}
-			if serialized, err = genesis.Serialize(); err != nil {
-				return err
+			if params := paramsOf(consensus); params.engine != "" && !params.equal(stored) {
+				return ErrConsensusMismatch
 			}
-			if err = b.Put(genesis.Hash, serialized); err != nil {
+			return nil
+		}
+		cbtx, err := CreateCoinbaseTX(address, netParams.GenesisMessage, 0)
+		if err != nil {
+			return err
+		}
+		buckets := []string{blocksBucket, utxoBucket, undoBucket, metaBucket, headersBucket, heightsBucket, txIndexBucket}
+		for _, bucket := range buckets {
+			if _, err = tx.CreateBucket([]byte(bucket)); err != nil {
 				return err
 			}
-			if err = b.Put([]byte("l"), genesis.Hash); err != nil {
+		}
+		genesis := NewGenesisBlock(cbtx)
+		if err = consensus.Prepare(txChainReader{tx}, genesis); err != nil {
+			return err
+		}
+		if err = consensus.Seal(context.Background(), genesis); err != nil {
+			return err
+		}
+		if err = putBlock(tx, genesis); err != nil {
+			return err
+		}
+		if err = putBlockMeta(tx, genesis.Hash, newBlockMeta(nil, consensus.Weight(genesis))); err != nil {
+			return err
+		}
+		if err = setMainChainBlock(tx, 0, genesis.Hash); err != nil {
+			return err
+		}
+		if params := paramsOf(consensus); params.engine != "" {
+			if err = putConsensusParams(tx, params); err != nil {
 				return err
 			}
-			tip = genesis.Hash
-		} else {
-			tip = b.Get([]byte("l"))
 		}
-		return nil
+		if err = connectTransactions(tx, genesis); err != nil {
+			return err
+		}
+		tip = genesis.Hash
+		return tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), tip)
 	})
 	if err != nil {
 		return nil, err
 	}
-	bc := Blockchain{tip, db}
+	bc := Blockchain{tip: tip, db: db, consensus: consensus}
 	return &bc, err
 }
 
-func (bc *Blockchain) MineBlock(transactions []*Transaction) error {
-	var lastHash, serialized []byte
-	var ok bool
+// MineBlock seals a block with the transactions on top of the tip using the
+// consensus engine and adds it to the chain. Sealing stops with the context's
+// error once the context is done.
+func (bc *Blockchain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	var lastHash []byte
 	var err error
-	for _, tx := range transactions {
-		if ok, err = bc.VerifyTransaction(tx); err != nil {
-			return err
-		}
-		if !ok {
-			return ErrIncorrectTransaction
-		}
+	if err = bc.validateTransactions(transactions); err != nil {
+		return nil, err
 	}
 
+	var height int
 	err = bc.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
-
+		lastHash = append([]byte{}, b.Get([]byte("l"))...)
+		last, err := getHeader(tx, lastHash)
+		if err != nil {
+			return err
+		}
+		height = last.Height + 1
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	newBlock := NewBlock(transactions, lastHash)
-	if serialized, err = newBlock.Serialize(); err != nil {
-		return err
+	newBlock := NewBlock(transactions, lastHash, height)
+	if err = bc.consensus.Prepare(bc, newBlock); err != nil {
+		return nil, err
+	}
+	if err = bc.consensus.Seal(ctx, newBlock); err != nil {
+		return nil, err
 	}
+	if err = bc.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
+	return newBlock, nil
+}
 
-	err = bc.db.Update(func(tx *bolt.Tx) error {
+// Generate mines n blocks on top of the tip, each holding only a coinbase
+// paying to the address, and returns their hashes. With the regtest network
+// it builds chains for tests instantly.
+func (bc *Blockchain) Generate(ctx context.Context, n int, address string) ([][]byte, error) {
+	if _, err := pubKeyHashFromAddress(address); err != nil {
+		return nil, err
+	}
+	var hashes [][]byte
+	for i := 0; i < n; i++ {
+		cbTx, err := CreateCoinbaseTX(address, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		block, err := bc.MineBlock(ctx, []*Transaction{cbTx})
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes, nil
+}
+
+// AddBlock stores a block whose parent is known and makes the chain with the
+// most cumulative work the main one, reorganizing the UTXO set if the block
+// ends up on a heavier branch. Blocks already stored are ignored.
+func (bc *Blockchain) AddBlock(block *Block) error {
+	_, err := bc.addBlock(block)
+	return err
+}
+
+// addBlock is AddBlock returning the blocks a reorganization disconnected from
+// the main chain, starting from the old tip.
+func (bc *Blockchain) addBlock(block *Block) ([]*Block, error) {
+	var tip []byte
+	var disconnected []*Block
+	err := bc.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		if err = b.Put(newBlock.Hash, serialized); err != nil {
+		tip = append([]byte{}, b.Get([]byte("l"))...)
+		if b.Get(block.Hash) != nil {
+			return nil
+		}
+		parent, err := getBlockMeta(tx, block.PrevBlockHash)
+		if err != nil {
+			if err == ErrBlockNotFound {
+				return ErrOrphanBlock
+			}
+			return err
+		}
+		if block.Height != parent.Height+1 || !block.hasValidMerkleRoot() || block.hasDuplicateTransactions() {
+			return ErrInvalidBlock
+		}
+		if err = checkTimestamp(txChainReader{tx}, &block.BlockHeader); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidBlock, err)
+		}
+		if err = bc.consensus.Verify(txChainReader{tx}, block); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidBlock, err)
+		}
+		meta := newBlockMeta(parent, bc.consensus.Weight(block))
+		if err = putBlock(tx, block); err != nil {
 			return err
 		}
-		if err = b.Put([]byte("l"), newBlock.Hash); err != nil {
+		if err = putBlockMeta(tx, block.Hash, meta); err != nil {
 			return err
 		}
-		bc.tip = newBlock.Hash
 
-		return nil
+		tipMeta, err := getBlockMeta(tx, tip)
+		if err != nil {
+			return err
+		}
+		if meta.Work.Cmp(tipMeta.Work) <= 0 {
+			return nil
+		}
+		if disconnected, err = reorganize(tx, tip, block.Hash); err != nil {
+			return err
+		}
+		tip = block.Hash
+		return b.Put([]byte("l"), tip)
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	bc.mu.Lock()
+	bc.tip = tip
+	bc.mu.Unlock()
+	return disconnected, nil
 }
 
-func (bc *Blockchain) Iterator() *BCIterator {
-	return &BCIterator{currentHash: bc.tip, db: bc.db}
+// reorganize switches the main chain from oldTip to newTip: blocks of the old
+// branch are disconnected down to the fork point and the blocks of the new one
+// are connected on top of it. It returns the disconnected blocks.
+func reorganize(tx *bolt.Tx, oldTip, newTip []byte) ([]*Block, error) {
+	var disconnect, connect []*Block
+	var disconnectHeights, connectHeights []int
+	oldHash, newHash := oldTip, newTip
+	for !bytes.Equal(oldHash, newHash) {
+		oldMeta, err := getBlockMeta(tx, oldHash)
+		if err != nil {
+			return nil, err
+		}
+		newMeta, err := getBlockMeta(tx, newHash)
+		if err != nil {
+			return nil, err
+		}
+		if newMeta.Height >= oldMeta.Height {
+			block, err := getBlock(tx, newHash)
+			if err != nil {
+				return nil, err
+			}
+			connect = append(connect, block)
+			connectHeights = append(connectHeights, newMeta.Height)
+			newHash = block.PrevBlockHash
+		}
+		if oldMeta.Height >= newMeta.Height {
+			block, err := getBlock(tx, oldHash)
+			if err != nil {
+				return nil, err
+			}
+			disconnect = append(disconnect, block)
+			disconnectHeights = append(disconnectHeights, oldMeta.Height)
+			oldHash = block.PrevBlockHash
+		}
+	}
+
+	for i, block := range disconnect {
+		if err := disconnectTransactions(tx, block); err != nil {
+			return nil, err
+		}
+		if err := unsetMainChainBlock(tx, disconnectHeights[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := len(connect) - 1; i >= 0; i-- {
+		if err := connectTransactions(tx, connect[i]); err != nil {
+			return nil, err
+		}
+		if err := setMainChainBlock(tx, connectHeights[i], connect[i].Hash); err != nil {
+			return nil, err
+		}
+	}
+	return disconnect, nil
 }
 
-func (bci *BCIterator) Next() (*Block, error) {
-	var block *Block
-	var err error
+func (bc *Blockchain) Tip() []byte {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.tip
+}
 
-	err = bci.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		encodedBlock := b.Get(bci.currentHash)
-		block, err = Deserialize(encodedBlock)
-		if err != nil {
-			return err
-		}
+func (bc *Blockchain) HasBlock(hash []byte) (bool, error) {
+	var exists bool
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(blocksBucket)).Get(hash) != nil
 		return nil
 	})
+	return exists, err
+}
+
+func (bc *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		block, err = getBlock(tx, hash)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	bci.currentHash = block.PrevBlockHash
-
 	return block, nil
 }
 
-func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) ([]Transaction, error) {
-	var unspentTXs []Transaction
-	spentTXOs := make(map[string][]int)
+func getBlock(tx *bolt.Tx, hash []byte) (*Block, error) {
+	encodedBlock := tx.Bucket([]byte(blocksBucket)).Get(hash)
+	if encodedBlock == nil {
+		return nil, ErrBlockNotFound
+	}
+	return Deserialize(encodedBlock)
+}
+
+// putBlock stores the block together with its header.
+func putBlock(tx *bolt.Tx, block *Block) error {
+	serialized, err := block.Serialize()
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket([]byte(blocksBucket)).Put(block.Hash, serialized); err != nil {
+		return err
+	}
+	return putHeader(tx, block.Hash, &block.BlockHeader)
+}
+
+// GetBlockHashes returns hashes of all the blocks of the main chain starting from the tip.
+func (bc *Blockchain) GetBlockHashes() ([][]byte, error) {
+	var hashes [][]byte
 	bci := bc.Iterator()
-	var usesKey bool
 	for {
 		block, err := bci.Next()
 		if err != nil {
 			return nil, err
 		}
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIDx, out := range tx.Vout {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIDx {
-							continue Outputs
-						}
-					}
-				}
-
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTXs = append(unspentTXs, *tx)
-				}
-			}
-
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Vin {
-					usesKey, err = in.UsesKey(pubKeyHash)
-					if err != nil {
-						return nil, err
-					}
-					if usesKey {
-						inTxID := hex.EncodeToString(in.Txid)
-						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-					}
-				}
-			}
-		}
+		hashes = append(hashes, block.Hash)
 		if len(block.PrevBlockHash) == 0 {
 			break
 		}
 	}
-	return unspentTXs, nil
+	return hashes, nil
 }
 
-func (bc *Blockchain) FindUTXO(pubKeyHash []byte) ([]TXOutput, error) {
-	var UTXOs []TXOutput
-	unspentTransactions, err := bc.FindUnspentTransactions(pubKeyHash)
+// Height returns the height of the main chain tip, genesis being at height 0.
+func (bc *Blockchain) Height() (int, error) {
+	header, err := bc.GetHeader(bc.Tip())
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Vout {
-			if out.IsLockedWithKey(pubKeyHash) {
-				UTXOs = append(UTXOs, out)
-			}
-		}
-	}
-	return UTXOs, nil
+	return header.Height, nil
 }
 
-func (bc *Blockchain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
-	unspentOutputs := make(map[string][]int)
-	unspentTXs, err := bc.FindUnspentTransactions(pubKeyHash)
+// BlockByHeight returns the main chain block at the height.
+func (bc *Blockchain) BlockByHeight(height int) (*Block, error) {
+	var block *Block
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		hash, err := getHashByHeight(tx, height)
+		if err != nil {
+			return err
+		}
+		block, err = getBlock(tx, hash)
+		return err
+	})
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-	accumulated := 0
+	return block, nil
+}
 
-Work:
-	for _, tx := range unspentTXs {
-		txID := hex.EncodeToString(tx.ID)
+// validateTransactions checks the transactions against the current UTXO set as
+// if they were included into a block on top of the tip. The changes they make
+// are kept in an overlay and dropped.
+func (bc *Blockchain) validateTransactions(transactions []*Transaction) error {
+	return bc.db.View(func(tx *bolt.Tx) error {
+		tipHash := tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+		tip, err := getHeader(tx, tipHash)
+		if err != nil {
+			return err
+		}
+		block := &Block{BlockHeader: BlockHeader{PrevBlockHash: tipHash, Height: tip.Height + 1}, Transactions: transactions}
+		_, err = applyTransactions(newOverlayView(bucketView{tx.Bucket([]byte(utxoBucket))}), block)
+		return err
+	})
+}
 
-		for outIdx, out := range tx.Vout {
-			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-				accumulated += out.Value
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+func (bc *Blockchain) Iterator() *BCIterator {
+	return &BCIterator{currentHash: bc.Tip(), db: bc.db}
+}
 
-				if accumulated >= amount {
-					break Work
-				}
-			}
+func (bci *BCIterator) Next() (*Block, error) {
+	var block *Block
+	var err error
+
+	err = bci.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		encodedBlock := b.Get(bci.currentHash)
+		block, err = Deserialize(encodedBlock)
+		if err != nil {
+			return err
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return accumulated, unspentOutputs, nil
+	bci.currentHash = block.PrevBlockHash
+
+	return block, nil
 }
 
+// FindTransaction returns the main chain transaction with the ID, looking it up
+// in the transaction index if it's enabled or scanning the chain otherwise.
 func (bc *Blockchain) FindTransaction(ID []byte) (*Transaction, error) {
+	var transaction *Transaction
+	var indexed bool
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		transaction, indexed, err = findIndexedTransaction(tx, ID)
+		return err
+	})
+	if indexed || err != nil {
+		return transaction, err
+	}
+
 	bci := bc.Iterator()
 
 	for {
@@ -270,6 +519,31 @@ func (bc *Blockchain) FindTransaction(ID []byte) (*Transaction, error) {
 	return nil, ErrTransactionNotFound
 }
 
+// UsedPubKeyHashes returns hex encoded hashes of all the public keys outputs
+// of the main chain were ever locked with.
+func (bc *Blockchain) UsedPubKeyHashes() (map[string]bool, error) {
+	used := make(map[string]bool)
+	bci := bc.Iterator()
+	for {
+		block, err := bci.Next()
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Vout {
+				if hash := out.lockingHash(); hash != nil {
+					used[hex.EncodeToString(hash)] = true
+				}
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return used, nil
+}
+
+// SignTransaction signs the transaction's inputs with the key and updates its ID.
 func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
 	prevTXs := make(map[string]Transaction)
 
@@ -283,10 +557,19 @@ func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 	if err := tx.Sing(privKey, prevTXs); err != nil {
 		return err
 	}
-	return nil
+	// the ID covers the unlocking scripts, so it changes with every signature
+	var err error
+	tx.ID, err = tx.Hash()
+	return err
 }
 
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) (bool, error) {
+	if tx.IsCoinbase() {
+		return true, nil
+	}
+	if tx.IsGovernance() {
+		return checkGovernanceTX(tx, bc.Tip()) == nil, nil
+	}
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
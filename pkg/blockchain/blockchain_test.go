@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+// mineOn seals a block with a coinbase paying to the address on top of the
+// parent, which doesn't have to be the tip.
+func mineOn(t *testing.T, bc *Blockchain, parent *Block, address string, txs ...*Transaction) *Block {
+	cbTx, err := CreateCoinbaseTX(address, "", 0)
+	require.NoError(t, err)
+	block := NewBlock(append([]*Transaction{cbTx}, txs...), parent.Hash, parent.Height+1)
+	require.NoError(t, bc.consensus.Prepare(bc, block))
+	require.NoError(t, bc.consensus.Seal(context.Background(), block))
+	return block
+}
+
+func hasUndo(t *testing.T, bc *Blockchain, block *Block) bool {
+	var exists bool
+	require.NoError(t, bc.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(undoBucket)).Get(block.Hash) != nil
+		return nil
+	}))
+	return exists
+}
+
+func requireMainChain(t *testing.T, bc *Blockchain, blocks ...*Block) {
+	require.Equal(t, blocks[len(blocks)-1].Hash, bc.Tip())
+	for _, block := range blocks {
+		stored, err := bc.BlockByHeight(block.Height)
+		require.NoError(t, err)
+		require.Equal(t, block.Hash, stored.Hash)
+		require.True(t, hasUndo(t, bc, block))
+	}
+	_, err := bc.BlockByHeight(blocks[len(blocks)-1].Height + 1)
+	require.ErrorIs(t, err, ErrBlockNotFound)
+}
+
+func requireBalances(t *testing.T, bc *Blockchain, balances map[string]int) {
+	for address, expected := range balances {
+		balance, err := bc.GetBalance(address)
+		require.NoError(t, err)
+		require.Equal(t, expected, balance, address)
+	}
+}
+
+func TestReorganize(t *testing.T) {
+	bc, wallet, from := newTestChain(t)
+	_, to := newTestAddress(t)
+	_, miner := newTestAddress(t)
+	mp := NewMempool(bc)
+	genesis, err := bc.GetBlock(bc.Tip())
+	require.NoError(t, err)
+	b1 := mineOn(t, bc, genesis, from)
+	require.NoError(t, mp.AddBlock(b1))
+
+	tx, err := CreateUTXOTransaction(wallet, to, 5, 0, nil, bc)
+	require.NoError(t, err)
+	m2 := mineOn(t, bc, b1, from, tx)
+	require.NoError(t, mp.AddBlock(m2))
+	requireMainChain(t, bc, genesis, b1, m2)
+	requireBalances(t, bc, map[string]int{from: 25, to: 5, miner: 0})
+
+	// a side branch of the same weight doesn't replace the main chain
+	s2 := mineOn(t, bc, b1, miner)
+	require.NoError(t, mp.AddBlock(s2))
+	requireMainChain(t, bc, genesis, b1, m2)
+	require.False(t, hasUndo(t, bc, s2))
+
+	s3 := mineOn(t, bc, s2, miner)
+	require.NoError(t, mp.AddBlock(s3))
+	requireMainChain(t, bc, genesis, b1, s2, s3)
+	require.False(t, hasUndo(t, bc, m2))
+	requireBalances(t, bc, map[string]int{from: 20, to: 0, miner: 20})
+	// the transaction of the disconnected block is pending again
+	_, ok := mp.Get(tx.ID)
+	require.True(t, ok)
+	_, err = bc.FindTransaction(tx.ID)
+	require.ErrorIs(t, err, ErrTransactionNotFound)
+
+	m3 := mineOn(t, bc, m2, from)
+	require.NoError(t, mp.AddBlock(m3))
+	m4 := mineOn(t, bc, m3, from)
+	require.NoError(t, mp.AddBlock(m4))
+	requireMainChain(t, bc, genesis, b1, m2, m3, m4)
+	require.False(t, hasUndo(t, bc, s2))
+	require.False(t, hasUndo(t, bc, s3))
+	requireBalances(t, bc, map[string]int{from: 45, to: 5, miner: 0})
+	require.Equal(t, 0, mp.Len())
+	require.NoError(t, bc.Validate(context.Background()))
+}
@@ -0,0 +1,47 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/boltdb/bolt"
+	"math/big"
+)
+
+const metaBucket = "blockmeta"
+
+// blockMeta is kept for every stored block, including the ones on side
+// branches, and is used for choosing the heaviest chain.
+type blockMeta struct {
+	Height int
+	Work   *big.Int
+}
+
+// newBlockMeta adds the weight of a block, as given by the consensus engine, to
+// the parent's one.
+func newBlockMeta(parent *blockMeta, weight *big.Int) *blockMeta {
+	if parent == nil {
+		return &blockMeta{Height: 0, Work: weight}
+	}
+	work := new(big.Int).Add(parent.Work, weight)
+	return &blockMeta{Height: parent.Height + 1, Work: work}
+}
+
+func getBlockMeta(tx *bolt.Tx, hash []byte) (*blockMeta, error) {
+	data := tx.Bucket([]byte(metaBucket)).Get(hash)
+	if data == nil {
+		return nil, ErrBlockNotFound
+	}
+	var meta blockMeta
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func putBlockMeta(tx *bolt.Tx, hash []byte, meta *blockMeta) error {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(meta); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(metaBucket)).Put(hash, buff.Bytes())
+}
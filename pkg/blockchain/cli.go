@@ -2,59 +2,246 @@ package blockchain
 
 import (
 	"flag"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
 	"os"
+	"strconv"
 	"strings"
 )
 
 type CLI struct {
 	bc  *Blockchain
 	log *logrus.Logger
+	rpc *RPCClient
+	// out receives the JSON printed by the commands, logs go to log
+	out io.Writer
 }
 
+// NewCLI returns the CLI printing JSON results to stdout, SetOutput changes it.
 func NewCLI(log *logrus.Logger, blockchain *Blockchain) *CLI {
-	return &CLI{bc: blockchain, log: log}
+	return &CLI{bc: blockchain, log: log, out: os.Stdout}
 }
 
+func (cli *CLI) SetOutput(out io.Writer) {
+	cli.out = out
+}
+
+// Run executes the command from os.Args. When RPC_CONNECT is set to the
+// address of an RPC server, the commands it supports are sent to it instead of
+// working with the local files, RPC_TOKEN being the server's auth token. The
+// -datadir and -network options preceding the command select the files and the
+// network parameters.
 func (cli *CLI) Run() error {
-	cli.validateArgs()
+	globalCmd := flag.NewFlagSet("blockchain-basics", flag.ExitOnError)
+	dataDir := globalCmd.String("datadir", "", "Directory keeping the networks' databases and wallets, defaults to "+DataDirEnv+" or ~/"+defaultDataDir)
+	network := globalCmd.String("network", os.Getenv(NetworkEnv), "Network to use: mainnet, testnet or regtest, defaults to "+NetworkEnv+" or mainnet")
+	if err := globalCmd.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	args := globalCmd.Args()
+	cli.validateArgs(args)
+	if *dataDir != "" {
+		SetDataDir(*dataDir)
+	}
+	if *network != "" {
+		params, err := NetworkByName(*network)
+		if err != nil {
+			return err
+		}
+		SetNetwork(params)
+	}
+	cli.warnLegacyFiles()
+	if address := os.Getenv("RPC_CONNECT"); address != "" {
+		cli.rpc = NewRPCClient(address, os.Getenv("RPC_TOKEN"))
+	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendManyCmd := flag.NewFlagSet("sendmany", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	validateChainCmd := flag.NewFlagSet("validatechain", flag.ExitOnError)
+	encryptWalletCmd := flag.NewFlagSet("encryptwallet", flag.ExitOnError)
+	changePassphraseCmd := flag.NewFlagSet("changepassphrase", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	getBlockCountCmd := flag.NewFlagSet("getblockcount", flag.ExitOnError)
+	startRPCCmd := flag.NewFlagSet("startrpc", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	recoverWalletCmd := flag.NewFlagSet("recoverwallet", flag.ExitOnError)
+	restoreWalletCmd := flag.NewFlagSet("restorewallet", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	spendMultisigCmd := flag.NewFlagSet("spendmultisig", flag.ExitOnError)
+	cosignCmd := flag.NewFlagSet("cosign", flag.ExitOnError)
+	proposeSignersCmd := flag.NewFlagSet("proposesigners", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockchainSigners := createBlockchainCmd.String("signers", "", "Comma separated list of signer addresses making the chain a proof of authority one, the first one sealing the genesis block")
+	createBlockchainPassphrase := createBlockchainCmd.String("passphrase", "", "Passphrase of the encrypted wallet file, asked for if not set")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendMiner := sendCmd.String("miner", "", "Address receiving the block reward, defaults to source address")
+	sendNode := sendCmd.String("node", "", "Relay the transaction to the node at host:port instead of mining it locally")
+	sendPassphrase := sendCmd.String("passphrase", "", "Passphrase of the encrypted wallet file, asked for if not set")
+	sendCoins := sendCmd.String("coins", DefaultCoinSelection, "Coin selection strategy: largest, smallest, bnb or random")
+	sendManyFrom := sendManyCmd.String("from", "", "Source wallet address")
+	sendManyTo := sendManyCmd.String("to", "", "Comma separated list of address:amount recipients")
+	sendManyFee := sendManyCmd.Int("fee", 0, "Fee paid to the miner")
+	sendManyMiner := sendManyCmd.String("miner", "", "Address receiving the block reward, defaults to source address")
+	sendManyNode := sendManyCmd.String("node", "", "Relay the transaction to the node at host:port instead of mining it locally")
+	sendManyPassphrase := sendManyCmd.String("passphrase", "", "Passphrase of the encrypted wallet file, asked for if not set")
+	sendManyCoins := sendManyCmd.String("coins", DefaultCoinSelection, "Coin selection strategy: largest, smallest, bnb or random")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "Wallet address to print the public key of")
+	getPubKeyPassphrase := getPubKeyCmd.String("passphrase", "", "Passphrase of the encrypted wallet file, asked for if not set")
+	createMultisigM := createMultisigCmd.Int("m", 0, "Number of signatures required to spend")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "Comma separated list of hex public keys or wallet addresses")
+	createMultisigPassphrase := createMultisigCmd.String("passphrase", "", "Passphrase of the encrypted wallet file, asked for if not set")
+	spendMultisigScript := spendMultisigCmd.String("script", "", "Hex script printed by createmultisig")
+	spendMultisigTo := spendMultisigCmd.String("to", "", "Comma separated list of address:amount recipients")
+	spendMultisigFee := spendMultisigCmd.Int("fee", 0, "Fee paid to the miner")
+	spendMultisigCoins := spendMultisigCmd.String("coins", DefaultCoinSelection, "Coin selection strategy: largest, smallest, bnb or random")
+	cosignTx := cosignCmd.String("tx", "", "Hex transaction printed by spendmultisig or by the previous cosigner")
+	cosignAddress := cosignCmd.String("address", "", "Wallet address whose key signs")
+	cosignMiner := cosignCmd.String("miner", "", "Address receiving the block reward, defaults to the signing address")
+	cosignNode := cosignCmd.String("node", "", "Relay the transaction to the node at host:port instead of mining it locally")
+	cosignPassphrase := cosignCmd.String("passphrase", "", "Passphrase of the encrypted wallet file, asked for if not set")
+	proposeSignersAddress := proposeSignersCmd.String("address", "", "Address of the current signer signing the change")
+	proposeSignersSigners := proposeSignersCmd.String("signers", "", "Comma separated list of the new signer addresses in the order they take turns")
+	proposeSignersTx := proposeSignersCmd.String("tx", "", "Hex transaction printed by the previous signer, signed instead of a new proposal")
+	proposeSignersNode := proposeSignersCmd.String("node", "", "Relay the transaction to the node at host:port instead of sealing it locally")
+	proposeSignersPassphrase := proposeSignersCmd.String("passphrase", "", "Passphrase of the encrypted wallet file, asked for if not set")
+	createWalletHD := createWalletCmd.Bool("hd", true, "Derive the address from the wallet seed, generating a mnemonic for it if there is none, -hd=false creates random keys while the wallet has no seed")
+	recoverWalletSeed := recoverWalletCmd.String("seed", "", "Hex encoded seed of the deterministic wallet")
+	recoverWalletGap := recoverWalletCmd.Int("gap", defaultGapLimit, "Number of consecutive unused addresses to stop the rescan at")
+	restoreWalletMnemonic := restoreWalletCmd.String("mnemonic", "", "Space separated mnemonic words of the deterministic wallet")
+	restoreWalletGap := restoreWalletCmd.Int("gap", defaultGapLimit, "Number of consecutive unused addresses to stop the rescan at")
+	encryptWalletPassphrase := encryptWalletCmd.String("passphrase", "", "New wallet passphrase, asked for if not set")
+	reindexTxIndex := reindexCmd.Bool("txindex", true, "Build the transaction index, -txindex=false drops it")
+	getBlockHash := getBlockCmd.String("hash", "", "Hex encoded hash of the block")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block in the main chain")
+	getTransactionID := getTransactionCmd.String("id", "", "Hex encoded transaction ID")
+	generateBlocks := generateCmd.Int("n", 1, "Number of blocks to mine")
+	generateAddress := generateCmd.String("address", "", "The address to send the block rewards to")
+	generatePassphrase := generateCmd.String("passphrase", "", "Passphrase of the encrypted wallet file signing proof of authority blocks, asked for if not set")
+	startRPCHost := startRPCCmd.String("host", "localhost", "Host to listen on")
+	startRPCPort := startRPCCmd.Int("port", netParams.RPCPort, "Port to listen on, defaults to the network's RPC port")
+	startRPCToken := startRPCCmd.String("token", "", "Token clients have to send in the Authorization header, defaults to RPC_TOKEN")
+	startNodeHost := startNodeCmd.String("host", "localhost", "Host the node is reachable at")
+	startNodePort := startNodeCmd.Int("port", netParams.Port, "Port to listen on, defaults to the network's port")
+	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining and send rewards to this address, whose key signs proof of authority blocks")
+	startNodePassphrase := startNodeCmd.String("passphrase", "", "Passphrase of the encrypted wallet file signing proof of authority blocks, asked for if not set")
+	startNodeWorkers := startNodeCmd.Int("workers", 0, "Number of mining goroutines, defaults to the number of CPUs")
+	startNodeSeeds := startNodeCmd.String("seeds", "", "Comma separated list of host:port peers to connect to")
 
-	switch strings.ToLower(os.Args[1]) {
+	switch strings.ToLower(args[0]) {
 	case "getbalance":
-		if err := getBalanceCmd.Parse(os.Args[2:]); err != nil {
+		if err := getBalanceCmd.Parse(args[1:]); err != nil {
 			return err
 		}
 	case "createblockchain":
-		if err := createBlockchainCmd.Parse(os.Args[2:]); err != nil {
+		if err := createBlockchainCmd.Parse(args[1:]); err != nil {
 			return err
 		}
 	case "createwallet":
-		if err := createWalletCmd.Parse(os.Args[2:]); err != nil {
+		if err := createWalletCmd.Parse(args[1:]); err != nil {
 			return err
 		}
 	case "listaddresses":
-		if err := listAddressesCmd.Parse(os.Args[2:]); err != nil {
+		if err := listAddressesCmd.Parse(args[1:]); err != nil {
 			return err
 		}
 	case "printchain":
-		if err := printChainCmd.Parse(os.Args[2:]); err != nil {
+		if err := printChainCmd.Parse(args[1:]); err != nil {
 			return err
 		}
 	case "send":
-		if err := sendCmd.Parse(os.Args[2:]); err != nil {
+		if err := sendCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "sendmany":
+		if err := sendManyCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "getpubkey":
+		if err := getPubKeyCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "createmultisig":
+		if err := createMultisigCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "spendmultisig":
+		if err := spendMultisigCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "cosign":
+		if err := cosignCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "proposesigners":
+		if err := proposeSignersCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "reindexutxo":
+		if err := reindexUTXOCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "reindex":
+		if err := reindexCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "startnode":
+		if err := startNodeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "validatechain":
+		if err := validateChainCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "encryptwallet":
+		if err := encryptWalletCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "changepassphrase":
+		if err := changePassphraseCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "recoverwallet":
+		if err := recoverWalletCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "restorewallet":
+		if err := restoreWalletCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "getblock":
+		if err := getBlockCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "gettransaction":
+		if err := getTransactionCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "getblockcount":
+		if err := getBlockCountCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "generate":
+		if err := generateCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "startrpc":
+		if err := startRPCCmd.Parse(args[1:]); err != nil {
 			return err
 		}
 	default:
@@ -67,7 +254,7 @@ func (cli *CLI) Run() error {
 			getBalanceCmd.Usage()
 			return nil
 		}
-		cli.getBalance([]byte(*getBalanceAddress))
+		cli.getBalance(*getBalanceAddress)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -75,11 +262,39 @@ func (cli *CLI) Run() error {
 			createBlockchainCmd.Usage()
 			return nil
 		}
-		cli.createBlockchain(*createBlockchainAddress)
+		var signers []string
+		if *createBlockchainSigners != "" {
+			signers = strings.Split(*createBlockchainSigners, ",")
+		}
+		cli.createBlockchain(*createBlockchainAddress, signers, *createBlockchainPassphrase)
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		cli.createWallet(*createWalletHD)
+	}
+
+	if recoverWalletCmd.Parsed() {
+		if *recoverWalletSeed == "" || *recoverWalletGap <= 0 {
+			recoverWalletCmd.Usage()
+			return nil
+		}
+		cli.recoverWallet(*recoverWalletSeed, *recoverWalletGap)
+	}
+
+	if restoreWalletCmd.Parsed() {
+		if *restoreWalletMnemonic == "" || *restoreWalletGap <= 0 {
+			restoreWalletCmd.Usage()
+			return nil
+		}
+		cli.restoreWallet(*restoreWalletMnemonic, *restoreWalletGap)
+	}
+
+	if encryptWalletCmd.Parsed() {
+		cli.encryptWallet(*encryptWalletPassphrase)
+	}
+
+	if changePassphraseCmd.Parsed() {
+		cli.changePassphrase()
 	}
 
 	if listAddressesCmd.Parsed() {
@@ -90,13 +305,159 @@ func (cli *CLI) Run() error {
 		cli.printChain()
 	}
 
+	if validateChainCmd.Parsed() {
+		cli.validateChain()
+	}
+
+	if reindexUTXOCmd.Parsed() {
+		cli.reindexUTXO()
+	}
+
+	if reindexCmd.Parsed() {
+		cli.reindex(*reindexTxIndex)
+	}
+
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		_, err := CoinSelectorByName(*sendCoins)
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || err != nil {
 			sendCmd.Usage()
 			return nil
 		}
+		if *sendMiner == "" {
+			*sendMiner = *sendFrom
+		}
+
+		cli.send(*sendFrom, *sendTo, *sendMiner, *sendNode, *sendPassphrase, *sendCoins, *sendAmount, *sendFee)
+	}
+
+	if sendManyCmd.Parsed() {
+		recipients, err := parseRecipients(*sendManyTo)
+		_, coinsErr := CoinSelectorByName(*sendManyCoins)
+		if *sendManyFrom == "" || err != nil || coinsErr != nil || *sendManyFee < 0 {
+			sendManyCmd.Usage()
+			return nil
+		}
+		if *sendManyMiner == "" {
+			*sendManyMiner = *sendManyFrom
+		}
+		cli.sendMany(*sendManyFrom, *sendManyMiner, *sendManyNode, *sendManyPassphrase, *sendManyCoins, recipients, *sendManyFee)
+	}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			return nil
+		}
+		cli.getPubKey(*getPubKeyAddress, *getPubKeyPassphrase)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *createMultisigM <= 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			return nil
+		}
+		cli.createMultisig(*createMultisigM, strings.Split(*createMultisigKeys, ","), *createMultisigPassphrase)
+	}
+
+	if spendMultisigCmd.Parsed() {
+		recipients, err := parseRecipients(*spendMultisigTo)
+		_, coinsErr := CoinSelectorByName(*spendMultisigCoins)
+		if *spendMultisigScript == "" || err != nil || coinsErr != nil || *spendMultisigFee < 0 {
+			spendMultisigCmd.Usage()
+			return nil
+		}
+		cli.spendMultisig(*spendMultisigScript, *spendMultisigCoins, recipients, *spendMultisigFee)
+	}
+
+	if cosignCmd.Parsed() {
+		if *cosignTx == "" || *cosignAddress == "" {
+			cosignCmd.Usage()
+			return nil
+		}
+		if *cosignMiner == "" {
+			*cosignMiner = *cosignAddress
+		}
+		cli.cosign(*cosignTx, *cosignAddress, *cosignMiner, *cosignNode, *cosignPassphrase)
+	}
+
+	if proposeSignersCmd.Parsed() {
+		if *proposeSignersAddress == "" || (*proposeSignersSigners == "") == (*proposeSignersTx == "") {
+			proposeSignersCmd.Usage()
+			return nil
+		}
+		var signers []string
+		if *proposeSignersSigners != "" {
+			signers = strings.Split(*proposeSignersSigners, ",")
+		}
+		cli.proposeSigners(*proposeSignersAddress, *proposeSignersTx, *proposeSignersNode, *proposeSignersPassphrase, signers)
+	}
+
+	if getBlockCmd.Parsed() {
+		if (*getBlockHash == "") == (*getBlockHeight < 0) {
+			getBlockCmd.Usage()
+			return nil
+		}
+		cli.getBlock(*getBlockHash, *getBlockHeight)
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionID == "" {
+			getTransactionCmd.Usage()
+			return nil
+		}
+		cli.getTransaction(*getTransactionID)
+	}
+
+	if getBlockCountCmd.Parsed() {
+		cli.getBlockCount()
+	}
+
+	if generateCmd.Parsed() {
+		if *generateBlocks <= 0 || *generateAddress == "" {
+			generateCmd.Usage()
+			return nil
+		}
+		cli.generate(*generateBlocks, *generateAddress, *generatePassphrase)
+	}
+
+	if startRPCCmd.Parsed() {
+		if *startRPCPort <= 0 {
+			startRPCCmd.Usage()
+			return nil
+		}
+		if *startRPCToken == "" {
+			*startRPCToken = os.Getenv("RPC_TOKEN")
+		}
+		cli.startRPC(fmt.Sprintf("%s:%d", *startRPCHost, *startRPCPort), *startRPCToken)
+	}
+
+	if startNodeCmd.Parsed() {
+		if *startNodePort <= 0 {
+			startNodeCmd.Usage()
+			return nil
+		}
+		var seeds []string
+		if *startNodeSeeds != "" {
+			seeds = strings.Split(*startNodeSeeds, ",")
+		}
+		cli.startNode(fmt.Sprintf("%s:%d", *startNodeHost, *startNodePort), *startNodeMiner, *startNodePassphrase, seeds, *startNodeWorkers)
 	}
 	return nil
 }
+
+// parseRecipients parses a comma separated list of address:amount pairs.
+func parseRecipients(list string) ([]Recipient, error) {
+	var recipients []Recipient
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("err malformed recipient %q", pair)
+		}
+		amount, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, Recipient{Address: parts[0], Amount: amount})
+	}
+	return recipients, nil
+}
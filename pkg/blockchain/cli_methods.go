@@ -1,13 +1,36 @@
 package blockchain
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
-func (cli *CLI) createBlockchain(address string) {
-	bc, err := CreateBlockchain(address)
+// createBlockchain creates a proof of work chain or, given the signers, a proof
+// of authority one whose genesis block is sealed by the first signer's key of
+// the wallet file.
+func (cli *CLI) createBlockchain(address string, signers []string, passphrase string) {
+	var consensus Consensus = NewPoWConsensus(nil)
+	if len(signers) > 0 {
+		wallet, err := cli.signer(signers[0], passphrase, nil)()
+		if err != nil {
+			cli.log.Warnf("err getting wallet: %s", err)
+			return
+		}
+		if consensus, err = NewPoAConsensus(signers, wallet); err != nil {
+			cli.log.Warnf("err creating consensus: %s", err)
+			return
+		}
+	}
+	bc, err := CreateBlockchainWithConsensus(address, consensus)
 	if err != nil {
 		cli.log.Warnf("err creating blockchain: %s", err)
 		return
@@ -19,7 +42,17 @@ func (cli *CLI) createBlockchain(address string) {
 }
 
 func (cli *CLI) printChain() {
-	bci := cli.bc.Iterator()
+	bc, err := GetBlockchain()
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	bci := bc.Iterator()
 	for {
 		block, err := bci.Next()
 		if err != nil {
@@ -29,8 +62,9 @@ func (cli *CLI) printChain() {
 		cli.log.Infof("Prev. hash: %x", block.PrevBlockHash)
 		cli.log.Infof("Transactions: %v", block.Transactions)
 		cli.log.Infof("Hash: %x", block.Hash)
-		pow := NewProofOfWork(block)
-		cli.log.Infof("PoW: %s", strconv.FormatBool(pow.Validate()))
+		cli.log.Infof("Merkle root: %x", block.HashMerkleRoot)
+		cli.log.Infof("Bits: %d", block.Bits)
+		cli.log.Infof("Seal: %s", strconv.FormatBool(bc.consensus.Verify(bc, block) == nil))
 
 		if len(block.PrevBlockHash) == 0 {
 			break
@@ -39,39 +73,140 @@ func (cli *CLI) printChain() {
 }
 
 func (cli *CLI) printUsage() {
-	cli.log.Infof("Usage:")
-	cli.log.Infof("  addblock -data BLOCK_DATA - add a block to the blockchain")
+	cli.log.Infof("Usage: [-datadir DIR] [-network mainnet|testnet|regtest] COMMAND")
+	cli.log.Infof("  createblockchain -address ADDRESS [-signers SIGNER,...] [-passphrase PASSPHRASE] - create a blockchain and send genesis block reward to ADDRESS, a proof of authority one sealed by the SIGNERs in turn if given")
+	cli.log.Infof("  createwallet [-hd=false] - derive a new key-pair from the wallet seed, printing the mnemonic of a new seed, or with -hd=false a random one while the wallet has no seed")
+	cli.log.Infof("  recoverwallet -seed SEED [-gap GAP] - restore deterministic wallet keys used on the chain")
+	cli.log.Infof("  restorewallet -mnemonic \"WORDS\" [-gap GAP] - restore deterministic wallet keys from the mnemonic backup")
+	cli.log.Infof("  getbalance -address ADDRESS - get balance of ADDRESS")
+	cli.log.Infof("  listaddresses - list all addresses from the wallet file")
 	cli.log.Infof("  printchain - print all the blocks of the blockchain")
+	cli.log.Infof("  reindexutxo - rebuild the UTXO set")
+	cli.log.Infof("  reindex [-txindex=false] - build the transaction index, which new chains keep by default, or drop it")
+	cli.log.Infof("  send -from FROM -to TO -amount AMOUNT [-fee FEE] [-miner MINER] [-node HOST:PORT] [-passphrase PASSPHRASE] [-coins largest|smallest|bnb|random] - send AMOUNT of coins from FROM address to TO, paying FEE to MINER or relaying the transaction to NODE")
+	cli.log.Infof("  sendmany -from FROM -to ADDRESS:AMOUNT,... [-fee FEE] [-miner MINER] [-node HOST:PORT] [-passphrase PASSPHRASE] [-coins STRATEGY] - pay every ADDRESS its AMOUNT in a single transaction")
+	cli.log.Infof("  getpubkey -address ADDRESS [-passphrase PASSPHRASE] - print the public key of ADDRESS to share it with the cosigners of a multisig")
+	cli.log.Infof("  createmultisig -m M -keys KEY,... [-passphrase PASSPHRASE] - create the address of the M of n multisig of the hex public keys or wallet addresses")
+	cli.log.Infof("  spendmultisig -script SCRIPT -to ADDRESS:AMOUNT,... [-fee FEE] [-coins STRATEGY] - create a transaction spending from the multisig of SCRIPT for the cosigners to sign")
+	cli.log.Infof("  cosign -tx TX -address ADDRESS [-miner MINER] [-node HOST:PORT] [-passphrase PASSPHRASE] - sign the multisig transaction with the key of ADDRESS, relaying or mining it once it has enough signatures")
+	cli.log.Infof("  proposesigners -address ADDRESS (-signers SIGNER,... | -tx TX) [-node HOST:PORT] [-passphrase PASSPHRASE] - propose the SIGNERs of a proof of authority chain for the next block, or sign the proposal TX of another signer, with the key of the current signer ADDRESS, relaying or sealing it once a majority of the signers signed it")
+	cli.log.Infof("  encryptwallet [-passphrase PASSPHRASE] - encrypt the wallet file with a passphrase")
+	cli.log.Infof("  changepassphrase - change the passphrase of an encrypted wallet file")
+	cli.log.Infof("  validatechain - replay the whole chain checking blocks and transactions")
+	cli.log.Infof("  getblock -hash HASH | -height HEIGHT - print the block with the given hash or the main chain block at HEIGHT")
+	cli.log.Infof("  gettransaction -id ID - print the transaction with the given ID")
+	cli.log.Infof("  getblockcount - print the height of the chain")
+	cli.log.Infof("  generate -n N -address ADDRESS [-passphrase PASSPHRASE] - mine N blocks paying their rewards to ADDRESS, instantly on regtest, or sign them with its key on proof of authority chains")
+	cli.log.Infof("  startrpc [-host HOST] [-port PORT] [-token TOKEN] - serve JSON-RPC requests, commands are sent to the server at RPC_CONNECT if set")
+	cli.log.Infof("  startnode [-host HOST] [-port PORT] [-miner ADDRESS] [-passphrase PASSPHRASE] [-workers N] [-seeds HOST:PORT,...] - start a node sharing the chain with its peers")
 }
 
-func (cli *CLI) validateArgs() {
-	if len(os.Args) < 2 {
+// warnLegacyFiles tells how to move the files found where they were kept before
+// the data directory, as they are no longer used there.
+func (cli *CLI) warnLegacyFiles() {
+	for path, target := range LegacyFiles() {
+		if _, err := os.Stat(target); err == nil {
+			cli.log.Warnf("%s is no longer used, the mainnet uses %s instead", path, target)
+			continue
+		}
+		cli.log.Warnf("%s is no longer used, move it to keep using it on the mainnet: mkdir -p %s && mv %s %s", path, filepath.Dir(target), path, target)
+	}
+}
+
+func (cli *CLI) validateArgs(args []string) {
+	if len(args) < 1 {
 		cli.printUsage()
 		os.Exit(1)
 	}
 }
 
-func (cli *CLI) getBalance(address []byte) {
+func (cli *CLI) getBalance(address string) {
+	if cli.rpc != nil {
+		var balance int
+		if err := cli.rpc.Call("getbalance", AddressParams{Address: address}, &balance); err != nil {
+			cli.log.Warnf("err getting balance: %s", err)
+			return
+		}
+		cli.log.Infof("Balance of %s: %d", address, balance)
+		return
+	}
 	bc, err := GetBlockchain()
 	if err != nil {
 		cli.log.Warnf("err getting blockchain: %s", err)
 		return
 	}
-	balance := 0
-	pubKeyHash := Base58Decode(address)
-	UTXOs, err := bc.FindUTXO(pubKeyHash[1 : len(pubKeyHash)-4])
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	balance, err := bc.GetBalance(address)
 	if err != nil {
-		cli.log.Warnf("err finding unspent transaction: %s", err)
+		cli.log.Warnf("err getting balance: %s", err)
 		return
 	}
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
 	cli.log.Infof("Balance of %s: %d", address, balance)
 }
 
-func (cli *CLI) send(from, to string, amount int) {
-	bc, err := GetBlockchain()
+func (cli *CLI) send(from, to, miner, node, passphrase, coins string, amount, fee int) {
+	if cli.rpc != nil && node == "" {
+		params := SendParams{From: from, To: to, Amount: amount, Fee: fee, Miner: miner, Passphrase: passphrase, CoinSelection: coins}
+		var result SendResult
+		if err := cli.callWallet("send", &params, &params.Passphrase, &result); err != nil {
+			cli.log.Warnf("err sending: %s", err)
+			return
+		}
+		cli.log.Infof("transaction %s mined in block %s", result.TxID, result.Block)
+		return
+	}
+	cli.sendTransaction(from, miner, node, passphrase, func(wallet *Wallet, bc *Blockchain) (*Transaction, error) {
+		selector, err := CoinSelectorByName(coins)
+		if err != nil {
+			return nil, err
+		}
+		return CreateUTXOTransaction(wallet, to, amount, fee, selector, bc)
+	})
+}
+
+func (cli *CLI) sendMany(from, miner, node, passphrase, coins string, recipients []Recipient, fee int) {
+	if cli.rpc != nil && node == "" {
+		params := SendManyParams{From: from, Recipients: recipients, Fee: fee, Miner: miner, Passphrase: passphrase, CoinSelection: coins}
+		var result SendResult
+		if err := cli.callWallet("sendmany", &params, &params.Passphrase, &result); err != nil {
+			cli.log.Warnf("err sending: %s", err)
+			return
+		}
+		cli.log.Infof("transaction %s mined in block %s", result.TxID, result.Block)
+		return
+	}
+	cli.sendTransaction(from, miner, node, passphrase, func(wallet *Wallet, bc *Blockchain) (*Transaction, error) {
+		selector, err := CoinSelectorByName(coins)
+		if err != nil {
+			return nil, err
+		}
+		return CreateSendManyTransaction(wallet, recipients, fee, selector, bc)
+	})
+}
+
+// sendTransaction creates a transaction spending from the wallet of the from
+// address and either relays it to the node or mines it locally, paying the
+// block reward to the miner.
+func (cli *CLI) sendTransaction(from, miner, node, passphrase string, create func(wallet *Wallet, bc *Blockchain) (*Transaction, error)) {
+	wallets, err := cli.openWallets(passphrase)
+	if err != nil {
+		cli.log.Warnf("err opening wallets: %s", err)
+		return
+	}
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		cli.log.Warnf("err getting wallet: %s", err)
+		return
+	}
+	sealer := miner
+	if node != "" {
+		sealer = ""
+	}
+	bc, err := GetBlockchainWithSealer(cli.newMiner(0), cli.signer(sealer, passphrase, wallets))
 	if err != nil {
 		cli.log.Warnf("err getting blockchain: %s", err)
 		return
@@ -83,23 +218,288 @@ func (cli *CLI) send(from, to string, amount int) {
 			return
 		}
 	}()
-	tx, err := CreateUTXOTransaction(from, to, amount, bc)
+	tx, err := create(wallet, bc)
 	if err != nil {
 		cli.log.Warnf("err creating transaction: %s", err)
 		return
 	}
-	if err = bc.MineBlock([]*Transaction{tx}); err != nil {
-		cli.log.Warnf("err mining block: %s", tx.ID)
+	cli.submitTransaction(bc, tx, miner, node)
+}
+
+// submitTransaction relays the transaction to the node or, without one, mines
+// it locally paying the block reward to the miner.
+func (cli *CLI) submitTransaction(bc *Blockchain, tx *Transaction, miner, node string) {
+	if node != "" {
+		if err := SubmitTransaction(node, tx); err != nil {
+			cli.log.Warnf("err submitting transaction: %s", err)
+			return
+		}
+		cli.log.Infof("transaction %x sent to %s", tx.ID, node)
+		return
+	}
+	mempool := NewMempool(bc)
+	if err := mempool.Add(tx); err != nil {
+		cli.log.Warnf("err adding transaction to mempool: %s", err)
 		return
 	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	block, err := mempool.AssembleBlock(ctx, miner, maxBlockTransactions)
+	if err != nil {
+		cli.log.Warnf("err mining block: %s", err)
+		return
+	}
+	cli.log.Infof("transaction %x mined in block %x", tx.ID, block.Hash)
 }
 
-func (cli *CLI) createWallet() {
-	wallets, err := GetWallets()
+// createMultisig prints the address and the script of the m of n multisig of
+// the keys, given either as hex public keys or as addresses of the wallet file.
+func (cli *CLI) createMultisig(m int, keys []string, passphrase string) {
+	pubKeys := make([][]byte, len(keys))
+	var wallets *Wallets
+	for i, key := range keys {
+		if pubKey, err := hex.DecodeString(key); err == nil && len(pubKey) == pubKeyLen {
+			pubKeys[i] = pubKey
+			continue
+		}
+		if wallets == nil {
+			var err error
+			if wallets, err = cli.openWallets(passphrase); err != nil {
+				cli.log.Warnf("err opening wallets: %s", err)
+				return
+			}
+		}
+		wallet, err := wallets.GetWallet(key)
+		if err != nil {
+			cli.log.Warnf("err getting wallet: %s", err)
+			return
+		}
+		pubKeys[i] = wallet.PublicKey
+	}
+	script, err := NewMultisigScript(m, pubKeys)
+	if err != nil {
+		cli.log.Warnf("err creating multisig script: %s", err)
+		return
+	}
+	address, err := script.Address()
+	if err != nil {
+		cli.log.Warnf("err getting multisig address: %s", err)
+		return
+	}
+	cli.log.Infof("multisig address: %s", address)
+	cli.log.Infof("script: %x", script.Serialize())
+}
+
+func (cli *CLI) getPubKey(address, passphrase string) {
+	wallets, err := cli.openWallets(passphrase)
+	if err != nil {
+		cli.log.Warnf("err opening wallets: %s", err)
+		return
+	}
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		cli.log.Warnf("err getting wallet: %s", err)
+		return
+	}
+	cli.log.Infof("public key of %s: %x", address, wallet.PublicKey)
+}
+
+// spendMultisig prints a transaction spending outputs of the multisig address,
+// which the cosigners sign in turn with cosign.
+func (cli *CLI) spendMultisig(scriptHex, coins string, recipients []Recipient, fee int) {
+	data, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		cli.log.Warnf("err decoding script: %s", err)
+		return
+	}
+	script, err := DeserializeMultisigScript(data)
+	if err != nil {
+		cli.log.Warnf("err decoding script: %s", err)
+		return
+	}
+	selector, err := CoinSelectorByName(coins)
+	if err != nil {
+		cli.log.Warnf("err choosing coin selection: %s", err)
+		return
+	}
+	bc, err := GetBlockchain()
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	tx, err := CreateMultisigTransaction(script, recipients, fee, selector, bc)
+	if err != nil {
+		cli.log.Warnf("err creating transaction: %s", err)
+		return
+	}
+	serialized, err := tx.Serialize()
+	if err != nil {
+		cli.log.Warnf("err serializing transaction: %s", err)
+		return
+	}
+	cli.log.Infof("unsigned transaction: %x", serialized)
+}
+
+// cosign adds the signature of the address' key to the multisig transaction.
+// Once it has enough signatures the transaction is relayed to the node or mined
+// locally, otherwise it's printed for the next cosigner.
+func (cli *CLI) cosign(txHex, address, miner, node, passphrase string) {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		cli.log.Warnf("err decoding transaction: %s", err)
+		return
+	}
+	tx, err := DeserializeTransaction(data)
+	if err != nil {
+		cli.log.Warnf("err decoding transaction: %s", err)
+		return
+	}
+	wallets, err := cli.openWallets(passphrase)
+	if err != nil {
+		cli.log.Warnf("err opening wallets: %s", err)
+		return
+	}
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		cli.log.Warnf("err getting wallet: %s", err)
+		return
+	}
+	sealer := miner
+	if node != "" {
+		sealer = ""
+	}
+	bc, err := GetBlockchainWithSealer(cli.newMiner(0), cli.signer(sealer, passphrase, wallets))
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	if err = bc.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		cli.log.Warnf("err signing transaction: %s", err)
+		return
+	}
+	signed, required, err := MultisigSignatures(tx)
+	if err != nil {
+		cli.log.Warnf("err counting signatures: %s", err)
+		return
+	}
+	if signed < required {
+		serialized, err := tx.Serialize()
+		if err != nil {
+			cli.log.Warnf("err serializing transaction: %s", err)
+			return
+		}
+		cli.log.Infof("%d of %d signatures, pass the transaction on to the next cosigner: %x", signed, required, serialized)
+		return
+	}
+	cli.submitTransaction(bc, tx, miner, node)
+}
+
+// proposeSigners signs a governance transaction replacing the signers of a
+// proof of authority chain with the address' key, creating it unless the hex
+// transaction of a previous signer is given. Once a majority of the signers
+// signed it, it's relayed to the node or sealed locally by the last signer,
+// otherwise it's printed for the next one. It applies only to the block on top
+// of the tip.
+func (cli *CLI) proposeSigners(address, txHex, node, passphrase string, signers []string) {
+	var tx *Transaction
+	if txHex != "" {
+		data, err := hex.DecodeString(txHex)
+		if err != nil {
+			cli.log.Warnf("err decoding transaction: %s", err)
+			return
+		}
+		if tx, err = DeserializeTransaction(data); err != nil {
+			cli.log.Warnf("err decoding transaction: %s", err)
+			return
+		}
+	}
+	wallets, err := cli.openWallets(passphrase)
+	if err != nil {
+		cli.log.Warnf("err opening wallets: %s", err)
+		return
+	}
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		cli.log.Warnf("err getting wallet: %s", err)
+		return
+	}
+	sealer := address
+	if node != "" {
+		sealer = ""
+	}
+	bc, err := GetBlockchainWithSealer(nil, cli.signer(sealer, passphrase, wallets))
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	if tx == nil {
+		if tx, err = NewGovernanceTX(wallet, signers, bc.Tip()); err != nil {
+			cli.log.Warnf("err creating transaction: %s", err)
+			return
+		}
+	} else if err = SignGovernanceTX(tx, wallet); err != nil {
+		cli.log.Warnf("err signing transaction: %s", err)
+		return
+	}
+	signed, required, err := bc.GovernanceSignatures(tx)
+	if err != nil {
+		cli.log.Warnf("err counting signatures: %s", err)
+		return
+	}
+	if signed < required {
+		serialized, err := tx.Serialize()
+		if err != nil {
+			cli.log.Warnf("err serializing transaction: %s", err)
+			return
+		}
+		cli.log.Infof("%d of %d signatures, pass the transaction on to the next signer: %x", signed, required, serialized)
+		return
+	}
+	cli.submitTransaction(bc, tx, address, node)
+}
+
+func (cli *CLI) createWallet(hd bool) {
+	if cli.rpc != nil {
+		params := WalletParams{HD: &hd}
+		var result CreateWalletResult
+		if err := cli.callWallet("createwallet", &params, &params.Passphrase, &result); err != nil {
+			cli.log.Warnf("err creating wallet: %s", err)
+			return
+		}
+		if result.Mnemonic != "" {
+			cli.log.Infof("wallet mnemonic, write it down to be able to restore the wallet: %s", result.Mnemonic)
+		}
+		cli.log.Infof("new address created: %s", result.Address)
+		return
+	}
+	wallets, err := cli.openWallets("")
 	if err != nil {
 		cli.log.Warnf("err creating wallets: %s", err)
 		return
 	}
+	if hd && !wallets.IsHD() {
+		mnemonic, err := wallets.InitMnemonic()
+		if err != nil {
+			cli.log.Warnf("err initializing deterministic wallet: %s", err)
+			return
+		}
+		cli.log.Infof("wallet mnemonic, write it down to be able to restore the wallet: %s", mnemonic)
+	}
 	address, err := wallets.CreateWallet()
 	if err != nil {
 		cli.log.Warnf("err creating wallet: %s", err)
@@ -112,10 +512,432 @@ func (cli *CLI) createWallet() {
 }
 
 func (cli *CLI) listAddresses() {
-	wallets, err := GetWallets()
+	if cli.rpc != nil {
+		var params WalletParams
+		var addresses []string
+		if err := cli.callWallet("listaddresses", &params, &params.Passphrase, &addresses); err != nil {
+			cli.log.Warnf("err listing addresses: %s", err)
+			return
+		}
+		cli.log.Info(strings.Join(addresses, " "))
+		return
+	}
+	wallets, err := cli.openWallets("")
 	if err != nil {
 		cli.log.Warnf("err creating wallets: %s", err)
 		return
 	}
 	cli.log.Info(strings.Join(wallets.GetAddresses(), " "))
 }
+
+func (cli *CLI) reindexUTXO() {
+	bc, err := GetBlockchain()
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	if err = bc.ReindexUTXO(); err != nil {
+		cli.log.Warnf("err reindexing utxo: %s", err)
+		return
+	}
+	count, err := bc.CountUTXOTransactions()
+	if err != nil {
+		cli.log.Warnf("err counting utxo transactions: %s", err)
+		return
+	}
+	cli.log.Infof("Done! There are %d transactions in the UTXO set.", count)
+}
+
+func (cli *CLI) reindex(txIndex bool) {
+	bc, err := GetBlockchain()
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	if !txIndex {
+		if err = bc.DropTxIndex(); err != nil {
+			cli.log.Warnf("err dropping transaction index: %s", err)
+			return
+		}
+		cli.log.Infof("transaction index dropped")
+		return
+	}
+	if err = bc.ReindexTransactions(); err != nil {
+		cli.log.Warnf("err reindexing transactions: %s", err)
+		return
+	}
+	cli.log.Infof("transaction index built")
+}
+
+func (cli *CLI) startNode(address, miner, passphrase string, seeds []string, workers int) {
+	bc, err := GetBlockchainWithSealer(cli.newMiner(workers), cli.signer(miner, passphrase, nil))
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	if err = NewNode(cli.log, bc, address, miner, seeds).Start(); err != nil {
+		cli.log.Warnf("err running node: %s", err)
+	}
+}
+
+// signer returns the function GetBlockchainWithSealer loads the wallet of the
+// address sealing proof of authority blocks with, from the wallets if they're
+// loaded already or from the wallet file. Without an address nothing is sealed.
+func (cli *CLI) signer(address, passphrase string, wallets *Wallets) func() (*Wallet, error) {
+	return func() (*Wallet, error) {
+		if address == "" {
+			return nil, nil
+		}
+		if wallets == nil {
+			var err error
+			if wallets, err = cli.openWallets(passphrase); err != nil {
+				return nil, err
+			}
+		}
+		return wallets.GetWallet(address)
+	}
+}
+
+// newMiner returns a miner logging its hashrate.
+func (cli *CLI) newMiner(workers int) *Miner {
+	miner := NewMiner(workers)
+	miner.OnHashrate = func(hashrate float64) {
+		cli.log.Infof("mining at %.0f H/s with %d workers", hashrate, miner.Workers)
+	}
+	return miner
+}
+
+func (cli *CLI) validateChain() {
+	bc, err := GetBlockchain()
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	err = bc.Validate(ctx)
+	var validationErr *BlockValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		cli.log.WithFields(logrus.Fields{
+			"height": validationErr.Height,
+			"hash":   fmt.Sprintf("%x", validationErr.Hash),
+			"tx":     fmt.Sprintf("%x", validationErr.TxID),
+		}).Warnf("chain is invalid: %s", validationErr.Err)
+	case err != nil:
+		cli.log.Warnf("err validating chain: %s", err)
+	default:
+		cli.log.Infof("chain is valid")
+	}
+}
+
+// callWallet calls a method using the server's wallet, asking for the
+// passphrase and retrying if the wallet turns out to be encrypted.
+func (cli *CLI) callWallet(method string, params interface{}, passphrase *string, result interface{}) error {
+	err := cli.rpc.Call(method, params, result)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Message != ErrWalletLocked.Error() {
+		return err
+	}
+	if *passphrase, err = readPassphrase("Enter wallet passphrase: "); err != nil {
+		return err
+	}
+	return cli.rpc.Call(method, params, result)
+}
+
+// getBlock prints the block with the given hash, or the main chain block at the
+// height if the hash is empty.
+func (cli *CLI) getBlock(hashHex string, height int) {
+	var block *BlockResult
+	if cli.rpc != nil {
+		params := BlockParams{Hash: hashHex}
+		if hashHex == "" {
+			params.Height = &height
+		}
+		if err := cli.rpc.Call("getblock", params, &block); err != nil {
+			cli.log.Warnf("err getting block: %s", err)
+			return
+		}
+	} else {
+		bc, err := GetBlockchain()
+		if err != nil {
+			cli.log.Warnf("err getting blockchain: %s", err)
+			return
+		}
+		defer func() {
+			if err = bc.db.Close(); err != nil {
+				cli.log.Warnf("err closing db: %s", err)
+			}
+		}()
+		var hash []byte
+		if hashHex == "" {
+			hash, err = bc.HashByHeight(height)
+		} else {
+			hash, err = hex.DecodeString(hashHex)
+		}
+		if err != nil {
+			cli.log.Warnf("err getting block hash: %s", err)
+			return
+		}
+		if block, err = bc.BlockResult(hash); err != nil {
+			cli.log.Warnf("err getting block: %s", err)
+			return
+		}
+	}
+	cli.printJSON(block)
+}
+
+func (cli *CLI) getTransaction(txIDHex string) {
+	var transaction *TransactionResult
+	if cli.rpc != nil {
+		if err := cli.rpc.Call("gettransaction", TxIDParams{TxID: txIDHex}, &transaction); err != nil {
+			cli.log.Warnf("err getting transaction: %s", err)
+			return
+		}
+	} else {
+		txID, err := hex.DecodeString(txIDHex)
+		if err != nil {
+			cli.log.Warnf("err decoding transaction id: %s", err)
+			return
+		}
+		bc, err := GetBlockchain()
+		if err != nil {
+			cli.log.Warnf("err getting blockchain: %s", err)
+			return
+		}
+		defer func() {
+			if err = bc.db.Close(); err != nil {
+				cli.log.Warnf("err closing db: %s", err)
+			}
+		}()
+		tx, err := bc.FindTransaction(txID)
+		if err != nil {
+			cli.log.Warnf("err getting transaction: %s", err)
+			return
+		}
+		transaction = newTransactionResult(tx, true)
+	}
+	cli.printJSON(transaction)
+}
+
+func (cli *CLI) getBlockCount() {
+	var height int
+	if cli.rpc != nil {
+		if err := cli.rpc.Call("getblockcount", nil, &height); err != nil {
+			cli.log.Warnf("err getting block count: %s", err)
+			return
+		}
+	} else {
+		bc, err := GetBlockchain()
+		if err != nil {
+			cli.log.Warnf("err getting blockchain: %s", err)
+			return
+		}
+		defer func() {
+			if err = bc.db.Close(); err != nil {
+				cli.log.Warnf("err closing db: %s", err)
+			}
+		}()
+		if height, err = bc.Height(); err != nil {
+			cli.log.Warnf("err getting block count: %s", err)
+			return
+		}
+	}
+	cli.log.Infof("%d", height)
+}
+
+func (cli *CLI) generate(n int, address, passphrase string) {
+	var hashes []string
+	if cli.rpc != nil {
+		if err := cli.rpc.Call("generate", GenerateParams{Blocks: n, Address: address}, &hashes); err != nil {
+			cli.log.Warnf("err generating blocks: %s", err)
+			return
+		}
+	} else {
+		bc, err := GetBlockchainWithSealer(cli.newMiner(0), cli.signer(address, passphrase, nil))
+		if err != nil {
+			cli.log.Warnf("err getting blockchain: %s", err)
+			return
+		}
+		defer func() {
+			if err = bc.db.Close(); err != nil {
+				cli.log.Warnf("err closing db: %s", err)
+			}
+		}()
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		generated, err := bc.Generate(ctx, n, address)
+		for _, hash := range generated {
+			hashes = append(hashes, hex.EncodeToString(hash))
+		}
+		if err != nil {
+			cli.log.Warnf("err generating blocks: %s", err)
+			return
+		}
+	}
+	cli.printJSON(hashes)
+}
+
+func (cli *CLI) printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		cli.log.Warnf("err encoding json: %s", err)
+		return
+	}
+	if _, err = fmt.Fprintln(cli.out, string(data)); err != nil {
+		cli.log.Warnf("err writing json: %s", err)
+	}
+}
+
+func (cli *CLI) startRPC(address, token string) {
+	bc, err := GetBlockchain()
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	if token == "" {
+		cli.log.Warnf("rpc server started without a token, anyone able to connect can spend the wallet's coins")
+	}
+	if err = NewRPCServer(cli.log, bc, token).ListenAndServe(address); err != nil {
+		cli.log.Warnf("err running rpc server: %s", err)
+	}
+}
+
+// openWallets loads the wallet file asking for the passphrase if the file is
+// encrypted and none was given.
+func (cli *CLI) openWallets(passphrase string) (*Wallets, error) {
+	wallets, err := LoadWallets(passphrase)
+	if err != ErrWalletLocked {
+		return wallets, err
+	}
+	if passphrase, err = readPassphrase("Enter wallet passphrase: "); err != nil {
+		return nil, err
+	}
+	return LoadWallets(passphrase)
+}
+
+func (cli *CLI) encryptWallet(passphrase string) {
+	wallets, err := GetWallets()
+	if err != nil {
+		cli.log.Warnf("err opening wallets: %s", err)
+		return
+	}
+	if passphrase == "" {
+		if passphrase, err = readNewPassphrase(); err != nil {
+			cli.log.Warnf("err reading passphrase: %s", err)
+			return
+		}
+	}
+	if err = wallets.Encrypt(passphrase); err != nil {
+		cli.log.Warnf("err encrypting wallets: %s", err)
+		return
+	}
+	if err = wallets.SaveToFile(); err != nil {
+		cli.log.Warnf("err saving to file: %s", err)
+		return
+	}
+	cli.log.Infof("wallet encrypted")
+}
+
+func (cli *CLI) changePassphrase() {
+	oldPassphrase, err := readPassphrase("Enter current passphrase: ")
+	if err != nil {
+		cli.log.Warnf("err reading passphrase: %s", err)
+		return
+	}
+	wallets, err := LoadWallets(oldPassphrase)
+	if err != nil {
+		cli.log.Warnf("err opening wallets: %s", err)
+		return
+	}
+	newPassphrase, err := readNewPassphrase()
+	if err != nil {
+		cli.log.Warnf("err reading passphrase: %s", err)
+		return
+	}
+	if err = wallets.ChangePassphrase(oldPassphrase, newPassphrase); err != nil {
+		cli.log.Warnf("err changing passphrase: %s", err)
+		return
+	}
+	if err = wallets.SaveToFile(); err != nil {
+		cli.log.Warnf("err saving to file: %s", err)
+		return
+	}
+	cli.log.Infof("passphrase changed")
+}
+
+func (cli *CLI) recoverWallet(seedHex string, gapLimit int) {
+	seed, err := hex.DecodeString(seedHex)
+	if err != nil {
+		cli.log.Warnf("err decoding seed: %s", err)
+		return
+	}
+	cli.recoverHDWallet(seed, gapLimit)
+}
+
+func (cli *CLI) restoreWallet(mnemonic string, gapLimit int) {
+	seed, err := NewSeed(mnemonic, "")
+	if err != nil {
+		cli.log.Warnf("err decoding mnemonic: %s", err)
+		return
+	}
+	cli.recoverHDWallet(seed, gapLimit)
+}
+
+func (cli *CLI) recoverHDWallet(seed []byte, gapLimit int) {
+	wallets, err := cli.openWallets("")
+	if err != nil {
+		cli.log.Warnf("err opening wallets: %s", err)
+		return
+	}
+	if err = wallets.InitHD(seed); err != nil {
+		cli.log.Warnf("err initializing deterministic wallet: %s", err)
+		return
+	}
+	bc, err := GetBlockchain()
+	if err != nil {
+		cli.log.Warnf("err getting blockchain: %s", err)
+		return
+	}
+	defer func() {
+		if err = bc.db.Close(); err != nil {
+			cli.log.Warnf("err closing db: %s", err)
+		}
+	}()
+	recovered, err := wallets.RecoverHD(bc, gapLimit)
+	if err != nil {
+		cli.log.Warnf("err recovering wallet: %s", err)
+		return
+	}
+	if err = wallets.SaveToFile(); err != nil {
+		cli.log.Warnf("err saving to file: %s", err)
+		return
+	}
+	cli.log.Infof("recovered %d used addresses and the unused ones up to the gap", recovered)
+}
@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCLIPrintsJSONToOutput(t *testing.T) {
+	SetDataDir(t.TempDir())
+	SetNetwork(&RegTestParams)
+	t.Cleanup(func() {
+		SetNetwork(&MainNetParams)
+	})
+	_, address := newTestAddress(t)
+	_, err := CreateBlockchain(address)
+	require.NoError(t, err)
+
+	var logs, out bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&logs)
+	cli := NewCLI(log, nil)
+	cli.SetOutput(&out)
+	cli.getBlock("", 0)
+
+	var block BlockResult
+	require.NoError(t, json.NewDecoder(&out).Decode(&block))
+	require.Equal(t, 0, block.Height)
+	require.Len(t, block.Transactions, 1)
+	require.Empty(t, logs.String())
+
+	cli.getBlock("", 1)
+	require.Zero(t, out.Len())
+	require.Contains(t, logs.String(), "err getting block")
+}
+
+func TestCLIWarnsAboutLegacyFiles(t *testing.T) {
+	dataDir := t.TempDir()
+	SetDataDir(dataDir)
+	workDir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(workDir))
+	t.Cleanup(func() {
+		require.NoError(t, os.Chdir(wd))
+	})
+
+	var logs bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&logs)
+	cli := NewCLI(log, nil)
+	cli.warnLegacyFiles()
+	require.Empty(t, logs.String())
+
+	legacy := filepath.Join(workDir, walletFile)
+	require.NoError(t, ioutil.WriteFile(legacy, nil, 0600))
+	target := filepath.Join(dataDir, MainNetParams.Name, walletFile)
+	require.Equal(t, map[string]string{legacy: target}, LegacyFiles())
+	cli.warnLegacyFiles()
+	require.Contains(t, logs.String(), "mv "+legacy+" "+target)
+
+	// the files of the mainnet directory are in use
+	require.NoError(t, os.MkdirAll(filepath.Dir(target), 0700))
+	require.NoError(t, os.Rename(legacy, target))
+	require.NoError(t, os.Chdir(filepath.Dir(target)))
+	require.Empty(t, LegacyFiles())
+}
@@ -0,0 +1,198 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// DefaultCoinSelection is the strategy used unless another one is chosen
+	DefaultCoinSelection = "bnb"
+	defaultBnBTries      = 100000
+)
+
+var ErrUnknownCoinSelector = errors.New("err unknown coin selection strategy")
+
+// SpendableOutput is an unspent output of a wallet together with its outpoint.
+type SpendableOutput struct {
+	Txid  []byte
+	Vout  int
+	Value int
+}
+
+// CoinSelector picks which of the wallet's unspent outputs a transaction
+// spends. The selected outputs are worth at least the target, which includes
+// the fee, the excess going back to the wallet as change.
+type CoinSelector interface {
+	Select(utxos []SpendableOutput, target int) ([]SpendableOutput, error)
+}
+
+// LargestFirst spends the largest outputs first, using few inputs.
+type LargestFirst struct{}
+
+func (LargestFirst) Select(utxos []SpendableOutput, target int) ([]SpendableOutput, error) {
+	sorted := sortOutputs(utxos, true)
+	return accumulate(sorted, target)
+}
+
+// SmallestFirst spends the smallest outputs first, consolidating the wallet.
+type SmallestFirst struct{}
+
+func (SmallestFirst) Select(utxos []SpendableOutput, target int) ([]SpendableOutput, error) {
+	sorted := sortOutputs(utxos, false)
+	return accumulate(sorted, target)
+}
+
+// BranchAndBound searches for outputs summing to the target plus at most
+// Tolerance, so that no change output or only a small one is needed. The
+// search gives up after MaxTries steps and then uses Fallback.
+type BranchAndBound struct {
+	Tolerance int
+	MaxTries  int
+	Fallback  CoinSelector
+}
+
+// NewBranchAndBound returns the exact match search falling back to
+// LargestFirst.
+func NewBranchAndBound() *BranchAndBound {
+	return &BranchAndBound{MaxTries: defaultBnBTries, Fallback: LargestFirst{}}
+}
+
+func (s *BranchAndBound) Select(utxos []SpendableOutput, target int) ([]SpendableOutput, error) {
+	sorted := sortOutputs(utxos, true)
+	// remaining[i] is the value of the outputs from i on, used to cut branches
+	// that can't reach the target anymore
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Value
+	}
+	if remaining[0] < target {
+		return nil, ErrInsufficientFunds
+	}
+
+	tries := 0
+	var selected []int
+	var search func(i, value int) bool
+	search = func(i, value int) bool {
+		tries++
+		if value >= target {
+			return value <= target+s.Tolerance
+		}
+		if i == len(sorted) || value+remaining[i] < target || tries > s.MaxTries {
+			return false
+		}
+		selected = append(selected, i)
+		if search(i+1, value+sorted[i].Value) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+		// skipping an output equal to the one just tried gives the same sums
+		next := i + 1
+		for next < len(sorted) && sorted[next].Value == sorted[i].Value {
+			next++
+		}
+		return search(next, value)
+	}
+	if search(0, 0) {
+		result := make([]SpendableOutput, len(selected))
+		for j, i := range selected {
+			result[j] = sorted[i]
+		}
+		return result, nil
+	}
+	if s.Fallback == nil {
+		return nil, ErrInsufficientFunds
+	}
+	return s.Fallback.Select(utxos, target)
+}
+
+// RandomImprove picks random outputs until the target is reached and then
+// keeps adding random outputs while they bring the change closer to the target
+// without exceeding twice the target. Change outputs similar in size to the
+// payments keep the wallet from fragmenting into dust.
+type RandomImprove struct {
+	Rand *rand.Rand
+}
+
+func (s RandomImprove) Select(utxos []SpendableOutput, target int) ([]SpendableOutput, error) {
+	shuffled := append([]SpendableOutput{}, utxos...)
+	shuffle := rand.Shuffle
+	if s.Rand != nil {
+		shuffle = s.Rand.Shuffle
+	}
+	shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	var selected []SpendableOutput
+	value := 0
+	i := 0
+	for ; i < len(shuffled) && value < target; i++ {
+		selected = append(selected, shuffled[i])
+		value += shuffled[i].Value
+	}
+	if value < target {
+		return nil, ErrInsufficientFunds
+	}
+	ideal, limit := 2*target, 3*target
+	for ; i < len(shuffled); i++ {
+		improved := value + shuffled[i].Value
+		if improved <= limit && abs(ideal-improved) < abs(ideal-value) {
+			selected = append(selected, shuffled[i])
+			value = improved
+		}
+	}
+	return selected, nil
+}
+
+// CoinSelectorByName returns the strategy for the send commands' flag: largest,
+// smallest, bnb or random.
+func CoinSelectorByName(name string) (CoinSelector, error) {
+	switch name {
+	case "largest":
+		return LargestFirst{}, nil
+	case "smallest":
+		return SmallestFirst{}, nil
+	case "bnb":
+		return NewBranchAndBound(), nil
+	case "random":
+		return RandomImprove{}, nil
+	}
+	return nil, ErrUnknownCoinSelector
+}
+
+// sortOutputs sorts a copy of the outputs by value, ties broken by outpoint so
+// that the selection is deterministic.
+func sortOutputs(utxos []SpendableOutput, descending bool) []SpendableOutput {
+	sorted := append([]SpendableOutput{}, utxos...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Value != sorted[j].Value {
+			return (sorted[i].Value > sorted[j].Value) == descending
+		}
+		if c := bytes.Compare(sorted[i].Txid, sorted[j].Txid); c != 0 {
+			return c < 0
+		}
+		return sorted[i].Vout < sorted[j].Vout
+	})
+	return sorted
+}
+
+func accumulate(sorted []SpendableOutput, target int) ([]SpendableOutput, error) {
+	value := 0
+	for i, out := range sorted {
+		value += out.Value
+		if value >= target {
+			return sorted[:i+1], nil
+		}
+	}
+	return nil, ErrInsufficientFunds
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
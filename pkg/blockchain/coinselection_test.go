@@ -0,0 +1,80 @@
+package blockchain
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testOutputs(values ...int) []SpendableOutput {
+	outputs := make([]SpendableOutput, len(values))
+	for i, value := range values {
+		outputs[i] = SpendableOutput{Txid: []byte{byte(i)}, Vout: i, Value: value}
+	}
+	return outputs
+}
+
+func selectedValue(outputs []SpendableOutput) int {
+	value := 0
+	for _, out := range outputs {
+		value += out.Value
+	}
+	return value
+}
+
+func TestCoinSelectors(t *testing.T) {
+	utxos := testOutputs(1, 7, 3, 20, 5, 12)
+	tests := []struct {
+		selector CoinSelector
+		target   int
+		change   int
+		inputs   int
+	}{
+		{LargestFirst{}, 15, 5, 1},
+		{SmallestFirst{}, 15, 1, 4},
+		{NewBranchAndBound(), 15, 0, 2},
+		{NewBranchAndBound(), 46, 1, 5},
+		{&BranchAndBound{Tolerance: 2, MaxTries: defaultBnBTries}, 14, 1, 2},
+	}
+	for _, test := range tests {
+		selected, err := test.selector.Select(utxos, test.target)
+		require.NoError(t, err)
+		require.Equal(t, test.change, selectedValue(selected)-test.target)
+		require.Len(t, selected, test.inputs)
+	}
+
+	for _, selector := range []CoinSelector{LargestFirst{}, SmallestFirst{}, NewBranchAndBound(), RandomImprove{}} {
+		_, err := selector.Select(utxos, 49)
+		require.ErrorIs(t, err, ErrInsufficientFunds)
+	}
+	_, err := CoinSelectorByName("nosuchstrategy")
+	require.ErrorIs(t, err, ErrUnknownCoinSelector)
+}
+
+func TestBranchAndBoundMinimizesChange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]int, 30)
+	for i := range values {
+		values[i] = 1 + r.Intn(100)
+	}
+	utxos := testOutputs(values...)
+	for target := 50; target < 1000; target += 13 {
+		exact, err := NewBranchAndBound().Select(utxos, target)
+		require.NoError(t, err)
+		require.Equal(t, target, selectedValue(exact))
+		for _, selector := range []CoinSelector{LargestFirst{}, SmallestFirst{}} {
+			selected, err := selector.Select(utxos, target)
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, selectedValue(selected), selectedValue(exact))
+		}
+	}
+}
+
+func TestRandomImprove(t *testing.T) {
+	utxos := testOutputs(1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
+	selected, err := RandomImprove{Rand: rand.New(rand.NewSource(1))}.Select(utxos, 10)
+	require.NoError(t, err)
+	// the change ends up as large as the payment, never above twice its size
+	require.Equal(t, 20, selectedValue(selected))
+}
@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ripemd160"
+	"math/big"
+)
+
+// ChainReader gives consensus engines access to the stored blocks. Blockchain
+// implements it, as does txChainReader within a db transaction.
+type ChainReader interface {
+	GetHeader(hash []byte) (*BlockHeader, error)
+	GetBlock(hash []byte) (*Block, error)
+}
+
+// Consensus decides how blocks are sealed, which sealed blocks are valid and
+// which branch is the main one.
+type Consensus interface {
+	// Prepare fills the consensus fields of a new block's header in, such as
+	// its difficulty.
+	Prepare(chain ChainReader, block *Block) error
+	// Seal makes a prepared block valid and sets its hash. It stops with the
+	// context's error once the context is done.
+	Seal(ctx context.Context, block *Block) error
+	// Verify checks the consensus fields and the seal of a block whose parent
+	// is stored.
+	Verify(chain ChainReader, block *Block) error
+	// Weight is what the block adds to the weight of its chain, the heaviest
+	// chain being the main one.
+	Weight(block *Block) *big.Int
+}
+
+type txChainReader struct {
+	tx *bolt.Tx
+}
+
+func (r txChainReader) GetHeader(hash []byte) (*BlockHeader, error) {
+	return getHeader(r.tx, hash)
+}
+
+func (r txChainReader) GetBlock(hash []byte) (*Block, error) {
+	return getBlock(r.tx, hash)
+}
+
+// consensusBucket keeps the parameters of the engine the chain was created
+// with, chains without it use the proof of work.
+const consensusBucket = "consensus"
+
+const (
+	PoWEngine = "pow"
+	PoAEngine = "poa"
+)
+
+var ErrConsensusMismatch = errors.New("err chain was created with another consensus")
+
+// consensusParams are what's stored of an engine to rebuild it when the chain
+// is opened.
+type consensusParams struct {
+	engine  string
+	signers [][]byte
+}
+
+// paramsOf returns the parameters of a built-in engine, other engines have an
+// empty name and aren't stored.
+func paramsOf(consensus Consensus) consensusParams {
+	switch c := consensus.(type) {
+	case *PoWConsensus:
+		return consensusParams{engine: PoWEngine}
+	case *PoAConsensus:
+		return consensusParams{engine: PoAEngine, signers: c.signers}
+	}
+	return consensusParams{}
+}
+
+func (p consensusParams) equal(other consensusParams) bool {
+	if p.engine != other.engine || len(p.signers) != len(other.signers) {
+		return false
+	}
+	for i := range p.signers {
+		if !bytes.Equal(p.signers[i], other.signers[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// newConsensus rebuilds the engine, sealing blocks with the miner under proof
+// of work or with the signer's wallet under proof of authority.
+func (p consensusParams) newConsensus(miner *Miner, signer *Wallet) Consensus {
+	if p.engine == PoAEngine {
+		return newPoAConsensus(p.signers, signer)
+	}
+	return NewPoWConsensus(miner)
+}
+
+func putConsensusParams(tx *bolt.Tx, params consensusParams) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(consensusBucket))
+	if err != nil {
+		return err
+	}
+	if err = b.Put([]byte("engine"), []byte(params.engine)); err != nil {
+		return err
+	}
+	return b.Put([]byte("signers"), bytes.Join(params.signers, nil))
+}
+
+func getConsensusParams(tx *bolt.Tx) (consensusParams, error) {
+	b := tx.Bucket([]byte(consensusBucket))
+	if b == nil {
+		return consensusParams{engine: PoWEngine}, nil
+	}
+	params := consensusParams{engine: string(b.Get([]byte("engine")))}
+	signers := b.Get([]byte("signers"))
+	if len(signers)%ripemd160.Size != 0 {
+		return consensusParams{}, fmt.Errorf("%w: malformed signers", ErrConsensusMismatch)
+	}
+	for i := 0; i < len(signers); i += ripemd160.Size {
+		params.signers = append(params.signers, append([]byte{}, signers[i:i+ripemd160.Size]...))
+	}
+	switch {
+	case params.engine == PoWEngine && len(params.signers) == 0:
+	case params.engine == PoAEngine && len(params.signers) > 0:
+	default:
+		return consensusParams{}, fmt.Errorf("%w: unknown engine %q", ErrConsensusMismatch, params.engine)
+	}
+	return params, nil
+}
@@ -0,0 +1,71 @@
+package blockchain
+
+import (
+	"github.com/boltdb/bolt"
+	"math"
+)
+
+const (
+	initialTargetBits = 24
+	minTargetBits     = 1
+	maxTargetBits     = 255
+	// retargetInterval is the number of blocks after which the difficulty is adjusted
+	retargetInterval = 10
+	// targetBlockTime is the desired number of seconds between blocks
+	targetBlockTime   = 10
+	maxRetargetFactor = 4
+)
+
+// RequiredBits returns the difficulty a block built on top of prevBlockHash must have.
+func (bc *Blockchain) RequiredBits(prevBlockHash []byte) (int, error) {
+	var bits int
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		bits, err = requiredBits(txChainReader{tx}, prevBlockHash)
+		return err
+	})
+	return bits, err
+}
+
+// requiredBits keeps the parent's difficulty except for every retargetInterval
+// block, where it compares the time the last interval took with the desired
+// one. The ratio is clamped to maxRetargetFactor in both directions and applied
+// as a number of target bits, one bit doubling the difficulty.
+func requiredBits(chain ChainReader, prevBlockHash []byte) (int, error) {
+	if len(prevBlockHash) == 0 {
+		return netParams.TargetBits, nil
+	}
+	parent, err := chain.GetHeader(prevBlockHash)
+	if err != nil {
+		return 0, err
+	}
+	if netParams.NoRetargeting || (parent.Height+1)%retargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := parent
+	for i := 0; i < retargetInterval-1; i++ {
+		if first, err = chain.GetHeader(first.PrevBlockHash); err != nil {
+			return 0, err
+		}
+	}
+	return retarget(parent.Bits, parent.Timestamp-first.Timestamp), nil
+}
+
+func retarget(bits int, actualTimespan int64) int {
+	expectedTimespan := int64((retargetInterval - 1) * targetBlockTime)
+	if actualTimespan < expectedTimespan/maxRetargetFactor {
+		actualTimespan = expectedTimespan / maxRetargetFactor
+	}
+	if actualTimespan > expectedTimespan*maxRetargetFactor {
+		actualTimespan = expectedTimespan * maxRetargetFactor
+	}
+	bits += int(math.Round(math.Log2(float64(expectedTimespan) / float64(actualTimespan))))
+	if bits < minTargetBits {
+		return minTargetBits
+	}
+	if bits > maxTargetBits {
+		return maxTargetBits
+	}
+	return bits
+}
@@ -0,0 +1,63 @@
+package blockchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetarget(t *testing.T) {
+	expected := int64((retargetInterval - 1) * targetBlockTime)
+
+	require.Equal(t, 20, retarget(20, expected))
+	require.Equal(t, 21, retarget(20, expected/2))
+	require.Equal(t, 19, retarget(20, expected*2))
+	// adjustments are clamped to maxRetargetFactor
+	require.Equal(t, 22, retarget(20, 0))
+	require.Equal(t, 18, retarget(20, expected*100))
+	require.Equal(t, minTargetBits, retarget(minTargetBits, expected*100))
+	require.Equal(t, maxTargetBits, retarget(maxTargetBits, 0))
+}
+
+func TestOutOfRangeBits(t *testing.T) {
+	bc, _, address := newTestChain(t)
+	genesis, err := bc.BlockByHeight(0)
+	require.NoError(t, err)
+	for _, bits := range []int{300, 256, 0, -1000} {
+		block := mineOn(t, bc, genesis, address)
+		block.Bits = bits
+		block.Hash = block.BlockHeader.Hash()
+		require.ErrorIs(t, bc.consensus.Verify(bc, block), ErrInvalidProofOfWork)
+		require.ErrorIs(t, bc.AddBlock(block), ErrInvalidBlock)
+	}
+}
+
+func TestBlockTimestamps(t *testing.T) {
+	bc, _, address := newTestChain(t)
+	genesis, err := bc.BlockByHeight(0)
+	require.NoError(t, err)
+	withTimestamp := func(timestamp int64) *Block {
+		block := mineOn(t, bc, genesis, address)
+		block.Timestamp = timestamp
+		require.NoError(t, bc.consensus.Seal(context.Background(), block))
+		return block
+	}
+
+	for _, block := range []*Block{
+		withTimestamp(genesis.Timestamp),
+		withTimestamp(genesis.Timestamp - 1000),
+		withTimestamp(time.Now().Unix() + maxFutureBlockTime + 60),
+	} {
+		err = bc.AddBlock(block)
+		require.ErrorIs(t, err, ErrInvalidBlock)
+		require.Contains(t, err.Error(), ErrInvalidTimestamp.Error())
+	}
+	require.NoError(t, bc.AddBlock(withTimestamp(genesis.Timestamp+1)))
+
+	// blocks mined within a second are dated past the median of their
+	// ancestors
+	_, err = bc.Generate(context.Background(), 2*medianTimeBlocks, address)
+	require.NoError(t, err)
+}
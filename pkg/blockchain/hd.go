@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// HardenedKeyStart is the first index of hardened child keys, which are
+// derived from the parent private key instead of the public one.
+const HardenedKeyStart = uint32(0x80000000)
+
+// SLIP-10 defines the master key derivation of BIP32 for the NIST P-256 curve
+var masterKeySalt = []byte("Nist256p1 seed")
+
+var ErrInvalidChildKey = errors.New("err derived key is invalid, use the next index")
+var ErrInvalidSeed = errors.New("err invalid seed")
+
+// ExtendedKey is a private key together with the chain code needed to derive
+// its children.
+type ExtendedKey struct {
+	Key       []byte
+	ChainCode []byte
+	Depth     byte
+	Index     uint32
+}
+
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, ErrInvalidSeed
+	}
+	data := seed
+	for {
+		mac := hmac.New(sha512.New, masterKeySalt)
+		mac.Write(data)
+		I := mac.Sum(nil)
+		key, chainCode := I[:32], I[32:]
+		if isValidScalar(new(big.Int).SetBytes(key)) {
+			return &ExtendedKey{Key: key, ChainCode: chainCode}, nil
+		}
+		data = I
+	}
+}
+
+// Child derives the child key with the given index: HMAC-SHA512 keyed with
+// the chain code over the parent key (private for hardened indexes, compressed
+// public otherwise) and the index, the left half being added to the parent key.
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	curve := elliptic.P256()
+	var data []byte
+	if index >= HardenedKeyStart {
+		data = append([]byte{0x00}, k.Key...)
+	} else {
+		x, y := curve.ScalarBaseMult(k.Key)
+		data = elliptic.MarshalCompressed(curve, x, y)
+	}
+	data = append(data, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(data[len(data)-4:], index)
+
+	mac := hmac.New(sha512.New, k.ChainCode)
+	mac.Write(data)
+	I := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(I[:32])
+	if il.Cmp(curve.Params().N) >= 0 {
+		return nil, ErrInvalidChildKey
+	}
+	childKey := il.Add(il, new(big.Int).SetBytes(k.Key))
+	childKey.Mod(childKey, curve.Params().N)
+	if childKey.Sign() == 0 {
+		return nil, ErrInvalidChildKey
+	}
+	return &ExtendedKey{
+		Key:       childKey.FillBytes(make([]byte, 32)),
+		ChainCode: I[32:],
+		Depth:     k.Depth + 1,
+		Index:     index,
+	}, nil
+}
+
+// Derive follows the path of child indexes starting from the key.
+func (k *ExtendedKey) Derive(path ...uint32) (*ExtendedKey, error) {
+	key := k
+	for _, index := range path {
+		var err error
+		if key, err = key.Child(index); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (k *ExtendedKey) Wallet() (*Wallet, error) {
+	return walletFromPrivateKey(k.Key)
+}
+
+func isValidScalar(k *big.Int) bool {
+	return k.Sign() > 0 && k.Cmp(elliptic.P256().Params().N) < 0
+}
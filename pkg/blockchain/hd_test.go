@@ -0,0 +1,28 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// SLIP-10 test vector 1 for nist256p1
+func TestExtendedKeyDerivation(t *testing.T) {
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	require.NoError(t, err)
+	master, err := NewMasterKey(seed)
+	require.NoError(t, err)
+	require.Equal(t, "beeb672fe4621673f722f38529c07392fecaa61015c80c34f29ce8b41b3cb6ea", hex.EncodeToString(master.ChainCode))
+	require.Equal(t, "612091aaa12e22dd2abef664f8a01a82cae99ad7441b7ef8110424915c268bc2", hex.EncodeToString(master.Key))
+
+	child, err := master.Derive(HardenedKeyStart)
+	require.NoError(t, err)
+	require.Equal(t, "3460cea53e6a6bb5fb391eeef3237ffd8724bf0a40e94943c98b83825342ee11", hex.EncodeToString(child.ChainCode))
+	require.Equal(t, "6939694369114c67917a182c59ddb8cafc3004e63ca5d3b84403ba8613debc0c", hex.EncodeToString(child.Key))
+
+	child, err = master.Derive(HardenedKeyStart, 1)
+	require.NoError(t, err)
+	require.Equal(t, "4187afff1aafa8445010097fb99d23aee9f599450c7bd140b6826ac22ba21d0c", hex.EncodeToString(child.ChainCode))
+	require.Equal(t, "284e9d38d07d21e4e281b645089a94f4cf5a5a81369acf151a1c3a57f18b2129", hex.EncodeToString(child.Key))
+}
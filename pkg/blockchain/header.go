@@ -0,0 +1,244 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+	"sort"
+	"time"
+)
+
+const (
+	headersBucket = "headers"
+	// heightsBucket maps heights of the main chain blocks to their hashes
+	heightsBucket = "heights"
+	blockVersion  = 1
+	// medianTimeBlocks is the number of ancestors whose median timestamp a
+	// block's timestamp has to exceed
+	medianTimeBlocks = 11
+	// maxFutureBlockTime is how many seconds a block's timestamp may be ahead
+	// of the local clock
+	maxFutureBlockTime = 2 * 60 * 60
+)
+
+var ErrInvalidTimestamp = errors.New("err invalid block timestamp")
+
+// BlockHeader holds the fields covered by the proof of work. Transactions are
+// committed to through the merkle root, so the header is hashed on its own.
+type BlockHeader struct {
+	Version        int
+	Height         int
+	PrevBlockHash  []byte
+	HashMerkleRoot []byte
+	Timestamp      int64
+	Bits           int
+	Nonce          int
+	// Signer and Signature seal the block under proof of authority, they are
+	// empty for proof of work blocks
+	Signer    []byte
+	Signature []byte
+}
+
+func (h *BlockHeader) Hash() []byte {
+	var e encoder
+	encodeHeader(&e, h)
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
+
+// SealHash is the hash signed by the block's signer, the hash of the header
+// without the signature.
+func (h *BlockHeader) SealHash() []byte {
+	unsigned := *h
+	unsigned.Signature = nil
+	return unsigned.Hash()
+}
+
+func (h *BlockHeader) Serialize() ([]byte, error) {
+	var e encoder
+	encodeHeader(&e, h)
+	return e.buf, nil
+}
+
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	d := decoder{data: data}
+	header := decodeHeader(&d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// GetHeader returns the header of any stored block, including side branches.
+func (bc *Blockchain) GetHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		header, err = getHeader(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// GetHeaderByHeight returns the header of the main chain block at the height.
+func (bc *Blockchain) GetHeaderByHeight(height int) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		hash, err := getHashByHeight(tx, height)
+		if err != nil {
+			return err
+		}
+		header, err = getHeader(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// GetHeaders returns up to count headers of the main chain starting from the
+// given height.
+func (bc *Blockchain) GetHeaders(fromHeight, count int) ([]*BlockHeader, error) {
+	var headers []*BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		if fromHeight < 0 {
+			return ErrBlockNotFound
+		}
+		c := tx.Bucket([]byte(heightsBucket)).Cursor()
+		for k, v := c.Seek(heightKey(fromHeight)); k != nil && len(headers) < count; k, v = c.Next() {
+			header, err := getHeader(tx, v)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// HashByHeight returns the hash of the main chain block at the height.
+func (bc *Blockchain) HashByHeight(height int) ([]byte, error) {
+	var hash []byte
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		hash, err = getHashByHeight(tx, height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+func getHeader(tx *bolt.Tx, hash []byte) (*BlockHeader, error) {
+	data := tx.Bucket([]byte(headersBucket)).Get(hash)
+	if data == nil {
+		return nil, ErrBlockNotFound
+	}
+	return DeserializeHeader(data)
+}
+
+func putHeader(tx *bolt.Tx, hash []byte, header *BlockHeader) error {
+	serialized, err := header.Serialize()
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(headersBucket)).Put(hash, serialized)
+}
+
+// heightKey is big endian so that the heights bucket is iterated in order.
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+func getHashByHeight(tx *bolt.Tx, height int) ([]byte, error) {
+	if height < 0 {
+		return nil, ErrBlockNotFound
+	}
+	hash := tx.Bucket([]byte(heightsBucket)).Get(heightKey(height))
+	if hash == nil {
+		return nil, ErrBlockNotFound
+	}
+	return append([]byte{}, hash...), nil
+}
+
+func setMainChainBlock(tx *bolt.Tx, height int, hash []byte) error {
+	return tx.Bucket([]byte(heightsBucket)).Put(heightKey(height), hash)
+}
+
+func unsetMainChainBlock(tx *bolt.Tx, height int) error {
+	return tx.Bucket([]byte(heightsBucket)).Delete(heightKey(height))
+}
+
+// reindexHeaders stores the headers of all the blocks, side branches included.
+func reindexHeaders(tx *bolt.Tx) error {
+	return tx.Bucket([]byte(blocksBucket)).ForEach(func(k, v []byte) error {
+		if string(k) == "l" {
+			return nil
+		}
+		block, err := Deserialize(v)
+		if err != nil {
+			return err
+		}
+		return putHeader(tx, block.Hash, &block.BlockHeader)
+	})
+}
+
+// medianTimePast returns the median timestamp of the block with the hash and
+// its ancestors, medianTimeBlocks of them at most.
+func medianTimePast(chain ChainReader, hash []byte) (int64, error) {
+	var timestamps []int64
+	for len(hash) > 0 && len(timestamps) < medianTimeBlocks {
+		header, err := chain.GetHeader(hash)
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, header.Timestamp)
+		hash = header.PrevBlockHash
+	}
+	if len(timestamps) == 0 {
+		return 0, nil
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// checkTimestamp rejects headers dated at or before the median time of their
+// ancestors or too far in the future, which would let miners skew retargeting.
+func checkTimestamp(chain ChainReader, header *BlockHeader) error {
+	median, err := medianTimePast(chain, header.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	if len(header.PrevBlockHash) > 0 && header.Timestamp <= median {
+		return ErrInvalidTimestamp
+	}
+	if header.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return ErrInvalidTimestamp
+	}
+	return nil
+}
+
+// prepareTimestamp moves the timestamp of a new block past the median time of
+// its ancestors, blocks mined within the same second would fail otherwise.
+func prepareTimestamp(chain ChainReader, header *BlockHeader) error {
+	median, err := medianTimePast(chain, header.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	if len(header.PrevBlockHash) > 0 && header.Timestamp <= median {
+		header.Timestamp = median + 1
+	}
+	return nil
+}
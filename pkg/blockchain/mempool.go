@@ -0,0 +1,239 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+)
+
+const maxBlockTransactions = 100
+
+var ErrMempoolConflict = errors.New("err transaction conflicts with a pooled transaction")
+var ErrAlreadyInMempool = errors.New("err transaction is already in mempool")
+
+type mempoolEntry struct {
+	tx   *Transaction
+	fee  int
+	size int
+}
+
+// Mempool keeps verified transactions waiting to be included into a block.
+type Mempool struct {
+	mu    sync.Mutex
+	bc    *Blockchain
+	txs   map[string]*mempoolEntry
+	spent map[string]string
+}
+
+func NewMempool(bc *Blockchain) *Mempool {
+	return &Mempool{
+		bc:    bc,
+		txs:   make(map[string]*mempoolEntry),
+		spent: make(map[string]string),
+	}
+}
+
+func (mp *Mempool) Add(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return ErrIncorrectTransaction
+	}
+	if err := checkTransactionID(tx); err != nil {
+		return err
+	}
+	height, err := mp.bc.Height()
+	if err != nil {
+		return err
+	}
+	if !tx.isFinal(height + 1) {
+		return ErrTransactionNotFinal
+	}
+	if tx.IsGovernance() {
+		if err = mp.bc.checkGovernance(tx); err != nil {
+			return err
+		}
+	} else {
+		ok, err := mp.bc.VerifyTransaction(tx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrIncorrectTransaction
+		}
+	}
+	fee, err := mp.bc.TransactionFee(tx)
+	if err != nil {
+		return err
+	}
+	serialized, err := tx.Serialize()
+	if err != nil {
+		return err
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.insert(tx, fee, len(serialized))
+}
+
+func (mp *Mempool) insert(tx *Transaction, fee, size int) error {
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := mp.txs[txID]; ok {
+		return ErrAlreadyInMempool
+	}
+	for _, vin := range tx.Vin {
+		if _, ok := mp.spent[vin.outpoint()]; ok {
+			return ErrMempoolConflict
+		}
+	}
+	for _, vin := range tx.Vin {
+		mp.spent[vin.outpoint()] = txID
+	}
+	mp.txs[txID] = &mempoolEntry{tx: tx, fee: fee, size: size}
+	return nil
+}
+
+func (mp *Mempool) Get(txID []byte) (*Transaction, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	entry, ok := mp.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+	return entry.tx, true
+}
+
+func (mp *Mempool) Len() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(mp.txs)
+}
+
+func (mp *Mempool) Remove(txID []byte) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.remove(hex.EncodeToString(txID))
+}
+
+func (mp *Mempool) remove(txID string) {
+	entry, ok := mp.txs[txID]
+	if !ok {
+		return
+	}
+	for _, vin := range entry.tx.Vin {
+		delete(mp.spent, vin.outpoint())
+	}
+	delete(mp.txs, txID)
+}
+
+// Select returns up to maxTxs pooled transactions with the highest fee per byte first.
+func (mp *Mempool) Select(maxTxs int) []*Transaction {
+	entries := mp.selectEntries(maxTxs)
+	txs := make([]*Transaction, 0, len(entries))
+	for _, entry := range entries {
+		txs = append(txs, entry.tx)
+	}
+	return txs
+}
+
+func (mp *Mempool) selectEntries(maxTxs int) []*mempoolEntry {
+	mp.mu.Lock()
+	entries := make([]*mempoolEntry, 0, len(mp.txs))
+	for _, entry := range mp.txs {
+		entries = append(entries, entry)
+	}
+	mp.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		left, right := entries[i].fee*entries[j].size, entries[j].fee*entries[i].size
+		if left != right {
+			return left > right
+		}
+		return hex.EncodeToString(entries[i].tx.ID) < hex.EncodeToString(entries[j].tx.ID)
+	})
+	if len(entries) > maxTxs {
+		entries = entries[:maxTxs]
+	}
+	return entries
+}
+
+// Evict drops the transactions included into the block as well as the ones
+// which became invalid because their inputs are no longer unspent, or because
+// they are governance transactions proposed on top of another block.
+func (mp *Mempool) Evict(block *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, tx := range block.Transactions {
+		mp.remove(hex.EncodeToString(tx.ID))
+	}
+	for txID, entry := range mp.txs {
+		if entry.tx.IsGovernance() {
+			if err := mp.bc.checkGovernance(entry.tx); err != nil {
+				mp.remove(txID)
+			}
+		} else if _, err := mp.bc.TransactionFee(entry.tx); err != nil {
+			mp.remove(txID)
+		}
+	}
+}
+
+// AddBlock adds the block to the chain and updates the pool. Besides evicting
+// the block's transactions, it returns the transactions of the blocks a
+// reorganization disconnected to the pool as long as they are still valid.
+func (mp *Mempool) AddBlock(block *Block) error {
+	disconnected, err := mp.bc.addBlock(block)
+	if err != nil {
+		return err
+	}
+	mp.Evict(block)
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			// transactions spending outputs of the disconnected blocks or
+			// included into the new branch are dropped
+			_ = mp.Add(tx)
+		}
+	}
+	return nil
+}
+
+// EvictInvalid drops the pooled transactions which can't be included into a
+// block on top of the tip anymore and returns how many were dropped.
+func (mp *Mempool) EvictInvalid() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	evicted := 0
+	for txID, entry := range mp.txs {
+		if err := mp.bc.validateTransactions([]*Transaction{entry.tx}); err != nil {
+			mp.remove(txID)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// AssembleBlock mines a single block containing the best pooled transactions
+// and a coinbase paying subsidy plus their fees to the miner.
+func (mp *Mempool) AssembleBlock(ctx context.Context, miner string, maxTxs int) (*Block, error) {
+	fees := 0
+	var selected []*Transaction
+	for _, entry := range mp.selectEntries(maxTxs) {
+		var err error
+		if fees, err = addValue(fees, entry.fee); err != nil {
+			return nil, err
+		}
+		selected = append(selected, entry.tx)
+	}
+	cbTx, err := CreateCoinbaseTX(miner, "", fees)
+	if err != nil {
+		return nil, err
+	}
+	block, err := mp.bc.MineBlock(ctx, append([]*Transaction{cbTx}, selected...))
+	if err != nil {
+		return nil, err
+	}
+	mp.Evict(block)
+	return block, nil
+}
@@ -0,0 +1,78 @@
+package blockchain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMempoolSelectByFeeRate(t *testing.T) {
+	mp := NewMempool(nil)
+	low := &Transaction{ID: []byte{1}, Vin: []TXInput{{Txid: []byte{0xa}, Vout: 0}}}
+	high := &Transaction{ID: []byte{2}, Vin: []TXInput{{Txid: []byte{0xb}, Vout: 0}}}
+	dense := &Transaction{ID: []byte{3}, Vin: []TXInput{{Txid: []byte{0xc}, Vout: 1}}}
+	require.NoError(t, mp.insert(low, 1, 100))
+	require.NoError(t, mp.insert(high, 10, 100))
+	require.NoError(t, mp.insert(dense, 5, 20))
+
+	require.Equal(t, []*Transaction{dense, high, low}, mp.Select(10))
+	require.Equal(t, []*Transaction{dense}, mp.Select(1))
+}
+
+func TestMempoolConflicts(t *testing.T) {
+	mp := NewMempool(nil)
+	tx := &Transaction{ID: []byte{1}, Vin: []TXInput{{Txid: []byte{0xa}, Vout: 0}}}
+	double := &Transaction{ID: []byte{2}, Vin: []TXInput{{Txid: []byte{0xa}, Vout: 0}}}
+	require.NoError(t, mp.insert(tx, 1, 100))
+	require.Equal(t, ErrAlreadyInMempool, mp.insert(tx, 1, 100))
+	require.Equal(t, ErrMempoolConflict, mp.insert(double, 2, 100))
+
+	mp.Remove(tx.ID)
+	require.NoError(t, mp.insert(double, 2, 100))
+	require.Equal(t, 1, mp.Len())
+}
+
+func TestMempoolRejectsInvalidInputs(t *testing.T) {
+	bc, wallet, _ := newTestChain(t)
+	thief, _ := newTestAddress(t)
+	_, to := newTestAddress(t)
+	mp := NewMempool(bc)
+
+	tx, err := CreateUTXOTransaction(wallet, to, 5, 1, nil, bc)
+	require.NoError(t, err)
+	// the genesis coinbase spent by tx has a single output
+	for _, vout := range []int{-1, 1, 1 << 30} {
+		bad := *tx
+		bad.Vin = []TXInput{{Txid: tx.Vin[0].Txid, Vout: vout, UnlockingScript: tx.Vin[0].UnlockingScript}}
+		bad.ID, err = bad.Hash()
+		require.NoError(t, err)
+		require.ErrorIs(t, mp.Add(&bad), ErrIncorrectTransaction)
+	}
+
+	stolen := *tx
+	stolen.Vin = []TXInput{{Txid: tx.Vin[0].Txid, Vout: tx.Vin[0].Vout}}
+	require.NoError(t, bc.SignTransaction(&stolen, thief.PrivateKey))
+	require.ErrorIs(t, mp.Add(&stolen), ErrIncorrectTransaction)
+
+	require.NoError(t, mp.Add(tx))
+	require.Equal(t, 1, mp.Len())
+}
+
+func TestMempoolEvictInvalid(t *testing.T) {
+	bc, wallet, _ := newTestChain(t)
+	_, to := newTestAddress(t)
+	mp := NewMempool(bc)
+
+	tx, err := CreateUTXOTransaction(wallet, to, 5, 1, nil, bc)
+	require.NoError(t, err)
+	require.NoError(t, mp.Add(tx))
+	require.Equal(t, 0, mp.EvictInvalid())
+
+	double, err := CreateUTXOTransaction(wallet, to, 6, 1, nil, bc)
+	require.NoError(t, err)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{double})
+	require.NoError(t, err)
+	require.Equal(t, 1, mp.EvictInvalid())
+	require.Equal(t, 0, mp.Len())
+}
@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+var ErrNotInMerkleTree = errors.New("err data is not in merkle tree")
+
+// leaves and inner nodes are hashed with different prefixes, so an inner node
+// can't be presented as a leaf
+const (
+	merkleLeafPrefix = byte(0x00)
+	merkleNodePrefix = byte(0x01)
+)
+
+// MerkleTree keeps every level of the tree, starting from the leaves. A level
+// with an odd number of nodes has its last node paired with itself.
+type MerkleTree struct {
+	levels [][][]byte
+}
+
+// MerkleProofStep is a sibling hash on the path from a leaf to the root. Left
+// is set when the sibling has to be put on the left side while hashing.
+type MerkleProofStep struct {
+	Hash []byte
+	Left bool
+}
+
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	if len(data) == 0 {
+		empty := sha256.Sum256(nil)
+		return &MerkleTree{levels: [][][]byte{{empty[:]}}}
+	}
+	level := make([][]byte, 0, len(data))
+	for _, datum := range data {
+		level = append(level, merkleLeafHash(datum))
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, merkleNodeHash(level[i], right))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return &MerkleTree{levels: levels}
+}
+
+func (t *MerkleTree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Proof returns the path proving that the index-th leaf belongs to the tree.
+func (t *MerkleTree) Proof(index int) ([]MerkleProofStep, error) {
+	if index < 0 || index >= len(t.levels[0]) {
+		return nil, ErrNotInMerkleTree
+	}
+	var proof []MerkleProofStep
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		proof = append(proof, MerkleProofStep{Hash: level[sibling], Left: sibling < index})
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks that data is included into the tree with the given root.
+func VerifyMerkleProof(root, data []byte, proof []MerkleProofStep) bool {
+	hash := merkleLeafHash(data)
+	for _, step := range proof {
+		if step.Left {
+			hash = merkleNodeHash(step.Hash, hash)
+		} else {
+			hash = merkleNodeHash(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
+
+func merkleLeafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+	return hash[:]
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{{merkleNodePrefix}, left, right}, []byte{}))
+	return hash[:]
+}
@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerkleTreeRoot(t *testing.T) {
+	data := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	ab := merkleNodeHash(merkleLeafHash(data[0]), merkleLeafHash(data[1]))
+	cc := merkleNodeHash(merkleLeafHash(data[2]), merkleLeafHash(data[2]))
+
+	require.Equal(t, merkleNodeHash(ab, cc), NewMerkleTree(data).Root())
+	require.Equal(t, merkleLeafHash(data[0]), NewMerkleTree(data[:1]).Root())
+	require.Equal(t,
+		"e9636069c740c9ff51625b01a0b040396d265a9b920cc6febdfa5ecc9f58ecce",
+		hex.EncodeToString(NewMerkleTree(data).Root()),
+	)
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var data [][]byte
+		for i := 0; i < n; i++ {
+			data = append(data, []byte(fmt.Sprintf("tx%d", i)))
+		}
+		tree := NewMerkleTree(data)
+		for i := range data {
+			proof, err := tree.Proof(i)
+			require.NoError(t, err)
+			require.True(t, VerifyMerkleProof(tree.Root(), data[i], proof), "n = %d, i = %d", n, i)
+			require.False(t, VerifyMerkleProof(tree.Root(), []byte("other"), proof), "n = %d, i = %d", n, i)
+		}
+		_, err := tree.Proof(n)
+		require.ErrorIs(t, err, ErrNotInMerkleTree)
+	}
+}
+
+func TestBlockMerkleProof(t *testing.T) {
+	block := &Block{Transactions: []*Transaction{{ID: []byte{1}}, {ID: []byte{2}}, {ID: []byte{3}}}}
+	proof, err := block.MerkleProof([]byte{3})
+	require.NoError(t, err)
+	require.True(t, VerifyMerkleProof(block.MerkleRoot(), []byte{3}, proof))
+
+	_, err = block.MerkleProof([]byte{4})
+	require.ErrorIs(t, err, ErrTransactionNotFound)
+}
+
+func TestDuplicateTransactionsRejected(t *testing.T) {
+	bc, wallet, _ := newTestChain(t)
+	other, address := newTestAddress(t)
+	_, to := newTestAddress(t)
+	_, err := bc.Generate(context.Background(), 1, address)
+	require.NoError(t, err)
+	tip, err := bc.GetBlock(bc.Tip())
+	require.NoError(t, err)
+
+	tx1, err := CreateUTXOTransaction(wallet, to, 3, 0, nil, bc)
+	require.NoError(t, err)
+	tx2, err := CreateUTXOTransaction(other, to, 4, 0, nil, bc)
+	require.NoError(t, err)
+	valid := mineOn(t, bc, tip, address, tx1, tx2)
+	require.Len(t, valid.Transactions, 3)
+	// a competing block makes the next ones a side branch, which is stored
+	// without its transactions being connected
+	require.NoError(t, bc.AddBlock(mineOn(t, bc, tip, address)))
+
+	mutated := *valid
+	mutated.Transactions = append(append([]*Transaction{}, valid.Transactions...), tx2)
+	require.Equal(t, valid.HashMerkleRoot, mutated.MerkleRoot())
+	require.ErrorIs(t, bc.AddBlock(&mutated), ErrInvalidBlock)
+	exists, err := bc.HasBlock(valid.Hash)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, bc.AddBlock(valid))
+	exists, err = bc.HasBlock(valid.Hash)
+	require.NoError(t, err)
+	require.True(t, exists)
+	stored, err := bc.GetBlock(valid.Hash)
+	require.NoError(t, err)
+	require.Len(t, stored.Transactions, 3)
+}
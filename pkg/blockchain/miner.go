@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHashrateInterval = 10 * time.Second
+
+// Miner searches for a nonce meeting the block's target, splitting the nonce
+// space between Workers goroutines. Once the whole space up to MaxNonce is
+// tried, the block's timestamp is bumped and the search starts over.
+type Miner struct {
+	Workers  int
+	MaxNonce int
+	// OnHashrate, if set, is called every HashrateInterval with the number of
+	// hashes per second tried since the previous call
+	OnHashrate       func(hashrate float64)
+	HashrateInterval time.Duration
+}
+
+// NewMiner returns a miner with the given number of workers, using all the CPUs
+// if workers isn't positive.
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{Workers: workers, MaxNonce: math.MaxInt64, HashrateInterval: defaultHashrateInterval}
+}
+
+// Mine sets the block's nonce, and possibly its timestamp, so that its hash
+// meets the target and fills the block's hash in. It stops with the context's
+// error when the context is done.
+func (m *Miner) Mine(ctx context.Context, block *Block) error {
+	var hashes uint64
+	if m.OnHashrate != nil && m.HashrateInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go m.reportHashrate(done, &hashes)
+	}
+	for {
+		nonce, hash, found := m.search(ctx, block, &hashes)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if found {
+			block.Nonce = nonce
+			block.Hash = hash
+			return nil
+		}
+		// every nonce failed, the header has to change for a new search
+		block.Timestamp++
+		if now := time.Now().Unix(); now > block.Timestamp {
+			block.Timestamp = now
+		}
+	}
+}
+
+// search tries every nonce up to MaxNonce once, worker i taking the nonces
+// equal to i modulo the number of workers.
+func (m *Miner) search(ctx context.Context, block *Block, hashes *uint64) (int, []byte, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	target := NewProofOfWork(block).target
+
+	type result struct {
+		nonce int
+		hash  []byte
+	}
+	results := make(chan result, m.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < m.Workers; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			header := block.BlockHeader
+			var hashInt big.Int
+			var tried uint64
+			defer func() { atomic.AddUint64(hashes, tried) }()
+			// nonce < 0 stops the worker when adding the step overflows
+			for nonce := start; nonce <= m.MaxNonce && nonce >= 0; nonce += m.Workers {
+				// checking the context on every hash would slow the loop down
+				if tried%1024 == 0 {
+					atomic.AddUint64(hashes, tried)
+					tried = 0
+					if ctx.Err() != nil {
+						return
+					}
+				}
+				header.Nonce = nonce
+				var e encoder
+				encodeHeader(&e, &header)
+				hash := sha256.Sum256(e.buf)
+				tried++
+				if hashInt.SetBytes(hash[:]).Cmp(target) == -1 {
+					results <- result{nonce: nonce, hash: hash[:]}
+					cancel()
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	if r, ok := <-results; ok {
+		return r.nonce, r.hash, true
+	}
+	return 0, nil, false
+}
+
+func (m *Miner) reportHashrate(done chan struct{}, hashes *uint64) {
+	ticker := time.NewTicker(m.HashrateInterval)
+	defer ticker.Stop()
+	last, lastTime := uint64(0), time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			current := atomic.LoadUint64(hashes)
+			m.OnHashrate(float64(current-last) / now.Sub(lastTime).Seconds())
+			last, lastTime = current, now
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMinerMine(t *testing.T) {
+	block := newTestBlock(12)
+	require.NoError(t, NewMiner(4).Mine(context.Background(), block))
+	require.True(t, NewProofOfWork(block).Validate(12))
+	require.Equal(t, block.BlockHeader.Hash(), block.Hash)
+}
+
+func TestMinerExhaustedNonces(t *testing.T) {
+	block := newTestBlock(12)
+	block.Timestamp = 1
+	miner := NewMiner(2)
+	miner.MaxNonce = 3
+	require.NoError(t, miner.Mine(context.Background(), block))
+	require.True(t, NewProofOfWork(block).Validate(12))
+	require.LessOrEqual(t, block.Nonce, 3)
+	require.Greater(t, block.Timestamp, int64(1))
+}
+
+func TestMinerCancel(t *testing.T) {
+	block := newTestBlock(200)
+	ctx, cancel := context.WithCancel(context.Background())
+	reported := make(chan float64, 1)
+	miner := NewMiner(2)
+	miner.HashrateInterval = 10 * time.Millisecond
+	miner.OnHashrate = func(hashrate float64) {
+		select {
+		case reported <- hashrate:
+		default:
+		}
+	}
+	go func() {
+		<-reported
+		cancel()
+	}()
+	require.ErrorIs(t, miner.Mine(ctx, block), context.Canceled)
+	require.Nil(t, block.Hash)
+}
+
+func newTestBlock(bits int) *Block {
+	block := NewBlock(nil, []byte{}, 0)
+	block.Bits = bits
+	return block
+}
@@ -0,0 +1,104 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"math/big"
+	"strings"
+)
+
+// BIP39 seeds are stretched with 2048 rounds of PBKDF2-HMAC-SHA512
+const (
+	mnemonicSeedIterations = 2048
+	mnemonicSeedLen        = 64
+)
+
+var ErrInvalidEntropy = errors.New("err entropy must be 128 to 256 bits, a multiple of 32")
+var ErrInvalidMnemonic = errors.New("err invalid mnemonic")
+var ErrMnemonicChecksum = errors.New("err mnemonic checksum mismatch")
+
+var bip39WordIndex = func() map[string]int {
+	index := make(map[string]int, len(bip39EnglishWords))
+	for i, word := range bip39EnglishWords {
+		index[word] = i
+	}
+	return index
+}()
+
+// NewEntropy returns bitSize random bits to build a mnemonic from.
+func NewEntropy(bitSize int) ([]byte, error) {
+	if !validEntropySize(bitSize) {
+		return nil, ErrInvalidEntropy
+	}
+	entropy := make([]byte, bitSize/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return nil, err
+	}
+	return entropy, nil
+}
+
+// NewMnemonic encodes the entropy followed by the first len(entropy)/4 bits of
+// its SHA-256 as words of 11 bits each.
+func NewMnemonic(entropy []byte) (string, error) {
+	if !validEntropySize(len(entropy) * 8) {
+		return "", ErrInvalidEntropy
+	}
+	checksumBits := uint(len(entropy) / 4)
+	hash := sha256.Sum256(entropy)
+	data := new(big.Int).SetBytes(entropy)
+	data.Lsh(data, checksumBits)
+	data.Or(data, big.NewInt(int64(hash[0]>>(8-checksumBits))))
+
+	words := make([]string, (len(entropy)*8+int(checksumBits))/11)
+	mask := big.NewInt(2047)
+	for i := len(words) - 1; i >= 0; i-- {
+		word := new(big.Int).And(data, mask)
+		words[i] = bip39EnglishWords[word.Int64()]
+		data.Rsh(data, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// MnemonicToEntropy decodes the mnemonic verifying its checksum.
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words)%3 != 0 || !validEntropySize(len(words)*11*32/33) {
+		return nil, ErrInvalidMnemonic
+	}
+	data := new(big.Int)
+	for _, word := range words {
+		index, ok := bip39WordIndex[word]
+		if !ok {
+			return nil, ErrInvalidMnemonic
+		}
+		data.Lsh(data, 11)
+		data.Or(data, big.NewInt(int64(index)))
+	}
+	checksumBits := uint(len(words) / 3)
+	checksum := new(big.Int).And(data, big.NewInt(1<<checksumBits-1))
+	data.Rsh(data, checksumBits)
+
+	entropy := data.FillBytes(make([]byte, len(words)*4/3))
+	hash := sha256.Sum256(entropy)
+	if checksum.Int64() != int64(hash[0]>>(8-checksumBits)) {
+		return nil, ErrMnemonicChecksum
+	}
+	return entropy, nil
+}
+
+// NewSeed checks the mnemonic and turns it into the seed of the HD wallet. The
+// passphrase is optional, a different passphrase gives a different seed.
+func NewSeed(mnemonic, passphrase string) ([]byte, error) {
+	if _, err := MnemonicToEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(mnemonic), []byte("mnemonic"+passphrase), mnemonicSeedIterations, mnemonicSeedLen, sha512.New), nil
+}
+
+func validEntropySize(bitSize int) bool {
+	return bitSize >= 128 && bitSize <= 256 && bitSize%32 == 0
+}
@@ -0,0 +1,189 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+)
+
+const (
+	maxMultisigKeys = 16
+	pubKeyLen       = 64
+)
+
+var ErrInvalidMultisig = errors.New("err invalid multisig script")
+var ErrNotCosigner = errors.New("err key is not part of the multisig script")
+
+// MultisigScript is the m of n condition of a multisig address, which is the
+// hash of the script. Outputs paying to the address are locked by a pay to
+// script hash script, spending them takes M signatures in the order of the keys
+// followed by the script itself.
+type MultisigScript struct {
+	M       int
+	PubKeys [][]byte
+}
+
+func NewMultisigScript(m int, pubKeys [][]byte) (*MultisigScript, error) {
+	script := &MultisigScript{M: m, PubKeys: pubKeys}
+	if err := script.check(); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+func (s *MultisigScript) check() error {
+	if s.M < 1 || s.M > len(s.PubKeys) || len(s.PubKeys) > maxMultisigKeys {
+		return ErrInvalidMultisig
+	}
+	seen := make(map[string]bool)
+	for _, pubKey := range s.PubKeys {
+		if len(pubKey) != pubKeyLen || seen[string(pubKey)] {
+			return ErrInvalidMultisig
+		}
+		seen[string(pubKey)] = true
+	}
+	return nil
+}
+
+// Serialize returns the script: <M> <public key>... <n> OP_CHECKMULTISIG.
+func (s *MultisigScript) Serialize() []byte {
+	b := NewScriptBuilder().AddInt(int64(s.M))
+	for _, pubKey := range s.PubKeys {
+		b.AddData(pubKey)
+	}
+	return b.AddInt(int64(len(s.PubKeys))).AddOp(OpCheckMultisig).Script()
+}
+
+func DeserializeMultisigScript(data []byte) (*MultisigScript, error) {
+	ops, err := parseScript(data)
+	if err != nil || len(ops) < 3 || ops[len(ops)-1].opcode != OpCheckMultisig {
+		return nil, ErrInvalidMultisig
+	}
+	m, n := smallInt(ops[0]), smallInt(ops[len(ops)-2])
+	keys := ops[1 : len(ops)-2]
+	if m < 0 || n != len(keys) {
+		return nil, ErrInvalidMultisig
+	}
+	pubKeys := make([][]byte, len(keys))
+	for i, op := range keys {
+		if op.opcode != pubKeyLen {
+			return nil, ErrInvalidMultisig
+		}
+		pubKeys[i] = append([]byte{}, op.data...)
+	}
+	return NewMultisigScript(m, pubKeys)
+}
+
+// smallInt returns the number pushed by OP_1 to OP_16, -1 for other opcodes.
+func smallInt(op scriptOp) int {
+	if op.opcode < Op1 || op.opcode > Op16 {
+		return -1
+	}
+	return int(op.opcode - Op1 + 1)
+}
+
+func (s *MultisigScript) Hash() ([]byte, error) {
+	return HashPubKey(s.Serialize())
+}
+
+func (s *MultisigScript) Address() ([]byte, error) {
+	hash, err := s.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return encodeAddress(netParams.MultisigVersion, hash), nil
+}
+
+func (s *MultisigScript) keyIndex(pubKey []byte) int {
+	for i, key := range s.PubKeys {
+		if bytes.Equal(key, pubKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+// multisigInput splits the unlocking script of an input spending a multisig
+// output into the signatures and the multisig script.
+func multisigInput(unlocking []byte) (*MultisigScript, [][]byte, error) {
+	data, err := pushedData(unlocking)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil, ErrInvalidMultisig
+	}
+	script, err := DeserializeMultisigScript(data[len(data)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return script, data[:len(data)-1], nil
+}
+
+// signMultisigInput adds the signature of the hash to the unlocking script,
+// keeping the signatures in the order of their keys.
+func signMultisigInput(unlocking []byte, privKey *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	script, signatures, err := multisigInput(unlocking)
+	if err != nil {
+		return nil, err
+	}
+	i := script.keyIndex(publicKeyBytes(&privKey.PublicKey))
+	if i < 0 {
+		return nil, ErrNotCosigner
+	}
+	slots := make([][]byte, len(script.PubKeys))
+	for _, signature := range signatures {
+		for j, pubKey := range script.PubKeys {
+			if verifyHash(pubKey, hash, signature) {
+				slots[j] = signature
+				break
+			}
+		}
+	}
+	if slots[i], err = signHash(privKey, hash); err != nil {
+		return nil, err
+	}
+	b := NewScriptBuilder()
+	for _, signature := range slots {
+		if signature != nil {
+			b.AddData(signature)
+		}
+	}
+	return b.AddData(script.Serialize()).Script(), nil
+}
+
+// CreateMultisigTransaction builds a transaction spending outputs locked to the
+// multisig script, the change going back to its address. The transaction has
+// no signatures yet, the cosigners add them with SignTransaction.
+func CreateMultisigTransaction(script *MultisigScript, recipients []Recipient, fee int, selector CoinSelector, bc *Blockchain) (*Transaction, error) {
+	hash, err := script.Hash()
+	if err != nil {
+		return nil, err
+	}
+	address, err := script.Address()
+	if err != nil {
+		return nil, err
+	}
+	unlocking := NewScriptBuilder().AddData(script.Serialize()).Script()
+	return createTransaction(hash, unlocking, string(address), recipients, fee, selector, bc)
+}
+
+// MultisigSignatures returns how many signatures the transaction's multisig
+// inputs have and how many they need at least, the input with the fewest
+// signatures counting.
+func MultisigSignatures(tx *Transaction) (int, int, error) {
+	signed, required := -1, 0
+	for _, vin := range tx.Vin {
+		script, signatures, err := multisigInput(vin.UnlockingScript)
+		if err != nil {
+			continue
+		}
+		if n := len(signatures); signed < 0 || n-script.M < signed-required {
+			signed, required = n, script.M
+		}
+	}
+	if signed < 0 {
+		return 0, 0, ErrIncorrectTransaction
+	}
+	return signed, required, nil
+}
@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultisigScript(t *testing.T) {
+	wallets := make([]*Wallet, 3)
+	pubKeys := make([][]byte, 3)
+	for i := range wallets {
+		wallets[i], _ = newTestAddress(t)
+		pubKeys[i] = wallets[i].PublicKey
+	}
+	script, err := NewMultisigScript(2, pubKeys)
+	require.NoError(t, err)
+	decoded, err := DeserializeMultisigScript(script.Serialize())
+	require.NoError(t, err)
+	require.Equal(t, script, decoded)
+
+	_, err = NewMultisigScript(4, pubKeys)
+	require.ErrorIs(t, err, ErrInvalidMultisig)
+	_, err = NewMultisigScript(1, [][]byte{pubKeys[0], pubKeys[0]})
+	require.ErrorIs(t, err, ErrInvalidMultisig)
+	_, err = DeserializeMultisigScript(script.Serialize()[1:])
+	require.ErrorIs(t, err, ErrInvalidMultisig)
+
+	address, err := script.Address()
+	require.NoError(t, err)
+	hash, err := lockingHashFromAddress(string(address))
+	require.NoError(t, err)
+	scriptHash, err := script.Hash()
+	require.NoError(t, err)
+	require.Equal(t, scriptHash, hash)
+	_, err = pubKeyHashFromAddress(string(address))
+	require.ErrorIs(t, err, ErrInvalidAddress)
+
+	_, to := newTestAddress(t)
+	prevTx := Transaction{ID: []byte{1}, Vout: []TXOutput{newTestOutput(t, 10, string(address))}}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx}
+	tx := &Transaction{
+		Vin:  []TXInput{{Txid: prevTx.ID, Vout: 0, UnlockingScript: NewScriptBuilder().AddData(script.Serialize()).Script()}},
+		Vout: []TXOutput{newTestOutput(t, 10, to)},
+	}
+	ok, err := tx.Verify(prevTXs)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, tx.Sing(wallets[2].PrivateKey, prevTXs))
+	signed, required, err := MultisigSignatures(tx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, []int{signed, required})
+	ok, err = tx.Verify(prevTXs)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, tx.Sing(wallets[0].PrivateKey, prevTXs))
+	ok, err = tx.Verify(prevTXs)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	outsider, _ := newTestAddress(t)
+	require.ErrorIs(t, tx.Sing(outsider.PrivateKey, prevTXs), ErrNotCosigner)
+
+	tampered := *tx
+	tampered.Vout = []TXOutput{newTestOutput(t, 9, to)}
+	ok, err = tampered.Verify(prevTXs)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestVerifyChecksLockingHash(t *testing.T) {
+	owner, address := newTestAddress(t)
+	thief, to := newTestAddress(t)
+	prevTx := Transaction{ID: []byte{1}, Vout: []TXOutput{newTestOutput(t, 10, address)}}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx}
+
+	tx := &Transaction{
+		Vin:  []TXInput{{Txid: prevTx.ID, Vout: 0}},
+		Vout: []TXOutput{newTestOutput(t, 10, to)},
+	}
+	require.NoError(t, tx.Sing(owner.PrivateKey, prevTXs))
+	ok, err := tx.Verify(prevTXs)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, tx.Sing(thief.PrivateKey, prevTXs))
+	ok, err = tx.Verify(prevTXs)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,168 @@
+package blockchain
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DataDirEnv and NetworkEnv name the environment variables selecting the
+	// data directory and the network when they aren't set explicitly
+	DataDirEnv     = "BLOCKCHAIN_DATADIR"
+	NetworkEnv     = "BLOCKCHAIN_NETWORK"
+	defaultDataDir = ".blockchain-basics"
+	dbFile         = "blockchain.db"
+	walletFile     = "wallet.dat"
+)
+
+var ErrUnknownNetwork = errors.New("err unknown network")
+
+// NetworkParams hold what tells the networks apart. Every network keeps its
+// database and wallet in a directory named after it inside the data directory.
+type NetworkParams struct {
+	Name string
+	// Magic starts the version message of the network's nodes, which drop
+	// peers sending another one
+	Magic          uint32
+	GenesisMessage string
+	// AddressVersion is the first byte of the network's addresses,
+	// MultisigVersion the one of its multisig addresses
+	AddressVersion  byte
+	MultisigVersion byte
+	Subsidy         int
+	// TargetBits is the difficulty of the genesis block, later blocks follow
+	// the retargeting rules unless NoRetargeting is set
+	TargetBits    int
+	NoRetargeting bool
+	Port          int
+	RPCPort       int
+}
+
+var MainNetParams = NetworkParams{
+	Name:            "mainnet",
+	Magic:           0xd9b4bef9,
+	GenesisMessage:  "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks",
+	AddressVersion:  0x00,
+	MultisigVersion: 0x05,
+	Subsidy:         10,
+	TargetBits:      initialTargetBits,
+	Port:            3000,
+	RPCPort:         8332,
+}
+
+var TestNetParams = NetworkParams{
+	Name:            "testnet",
+	Magic:           0x0709110b,
+	GenesisMessage:  "Testnet genesis block",
+	AddressVersion:  0x6f,
+	MultisigVersion: 0xc4,
+	Subsidy:         10,
+	TargetBits:      16,
+	Port:            13000,
+	RPCPort:         18332,
+}
+
+// RegTestParams are meant for tests: the target is met by every other hash and
+// never changes, so blocks are generated instantly.
+var RegTestParams = NetworkParams{
+	Name:            "regtest",
+	Magic:           0xdab5bffa,
+	GenesisMessage:  "Regtest genesis block",
+	AddressVersion:  0x6f,
+	MultisigVersion: 0xc4,
+	Subsidy:         10,
+	TargetBits:      minTargetBits,
+	NoRetargeting:   true,
+	Port:            23000,
+	RPCPort:         18443,
+}
+
+var networks = []*NetworkParams{&MainNetParams, &TestNetParams, &RegTestParams}
+
+// netParams is the network the package works with, dataDir overrides the
+// default data directory when set.
+var (
+	netParams = &MainNetParams
+	dataDir   string
+)
+
+// NetworkByName returns the predefined network with the name.
+func NetworkByName(name string) (*NetworkParams, error) {
+	for _, params := range networks {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, ErrUnknownNetwork
+}
+
+// SetNetwork selects the network the package works with: its addresses,
+// subsidy, difficulty and files.
+func SetNetwork(params *NetworkParams) {
+	netParams = params
+}
+
+func Network() *NetworkParams {
+	return netParams
+}
+
+// SetDataDir sets the directory the networks keep their files in.
+func SetDataDir(dir string) {
+	dataDir = dir
+}
+
+// DataDir returns the directory set by SetDataDir, falling back to the
+// BLOCKCHAIN_DATADIR environment variable and then to ~/.blockchain-basics.
+func DataDir() string {
+	if dataDir != "" {
+		return dataDir
+	}
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return defaultDataDir
+	}
+	return filepath.Join(home, defaultDataDir)
+}
+
+// networkDir returns the directory of the selected network creating it if it's
+// missing.
+func networkDir() (string, error) {
+	dir := filepath.Join(DataDir(), netParams.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func dbPath() string {
+	return filepath.Join(DataDir(), netParams.Name, dbFile)
+}
+
+func walletPath() string {
+	return filepath.Join(DataDir(), netParams.Name, walletFile)
+}
+
+// LegacyFiles returns the database and wallet files found in the working
+// directory, where they were kept before the data directory, mapped to the
+// paths they belong at now. They hold mainnet data.
+func LegacyFiles() map[string]string {
+	files := make(map[string]string)
+	for _, name := range []string{dbFile, walletFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		target := filepath.Join(DataDir(), MainNetParams.Name, name)
+		if targetInfo, err := os.Stat(target); err == nil && os.SameFile(info, targetInfo) {
+			continue
+		}
+		if path, err := filepath.Abs(name); err == nil {
+			files[path] = target
+		}
+	}
+	return files
+}
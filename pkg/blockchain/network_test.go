@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworks(t *testing.T) {
+	SetDataDir(t.TempDir())
+	defer SetNetwork(&MainNetParams)
+
+	wallet, err := CreateWallet()
+	require.NoError(t, err)
+	mainAddress, err := wallet.GetAddress()
+	require.NoError(t, err)
+	wallets, err := GetWallets()
+	require.NoError(t, err)
+	_, err = wallets.CreateWallet()
+	require.NoError(t, err)
+	require.NoError(t, wallets.SaveToFile())
+
+	params, err := NetworkByName("testnet")
+	require.NoError(t, err)
+	SetNetwork(params)
+	testAddress, err := wallet.GetAddress()
+	require.NoError(t, err)
+	require.NotEqual(t, mainAddress, testAddress)
+	_, err = pubKeyHashFromAddress(string(mainAddress))
+	require.ErrorIs(t, err, ErrInvalidAddress)
+	_, err = pubKeyHashFromAddress(string(testAddress))
+	require.NoError(t, err)
+
+	_, err = os.Stat(walletPath())
+	require.True(t, os.IsNotExist(err))
+	wallets, err = GetWallets()
+	require.NoError(t, err)
+	require.Empty(t, wallets.GetAddresses())
+
+	_, err = NetworkByName("nosuchnet")
+	require.ErrorIs(t, err, ErrUnknownNetwork)
+}
+
+func TestRegTestGenerate(t *testing.T) {
+	SetDataDir(t.TempDir())
+	SetNetwork(&RegTestParams)
+	defer SetNetwork(&MainNetParams)
+
+	wallet, err := CreateWallet()
+	require.NoError(t, err)
+	address, err := wallet.GetAddress()
+	require.NoError(t, err)
+	_, err = CreateBlockchain(string(address))
+	require.NoError(t, err)
+	bc, err := GetBlockchain()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, bc.db.Close())
+	}()
+
+	hashes, err := bc.Generate(context.Background(), 100, string(address))
+	require.NoError(t, err)
+	require.Len(t, hashes, 100)
+	height, err := bc.Height()
+	require.NoError(t, err)
+	require.Equal(t, 100, height)
+	require.Equal(t, hashes[99], bc.Tip())
+	balance, err := bc.GetBalance(string(address))
+	require.NoError(t, err)
+	require.Equal(t, 101*RegTestParams.Subsidy, balance)
+	require.NoError(t, bc.Validate(context.Background()))
+}
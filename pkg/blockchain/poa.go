@@ -0,0 +1,406 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"sync"
+)
+
+// governanceVout marks the single input of a governance transaction, the way
+// -1 marks the coinbase one. The input's Txid is the hash of the block the
+// proposal is made on top of, so it can only be included into the next block
+// and never replayed later. Pooled governance transactions share the outpoint,
+// so only one signer set change is pending at a time. The unlocking script
+// pushes a signature and a public key for every signer approving the change.
+const governanceVout = -2
+
+var ErrUnauthorizedSigner = errors.New("err signer is not authorized")
+var ErrOutOfTurnSigner = errors.New("err block is sealed out of turn")
+var ErrInvalidSeal = errors.New("err invalid block seal")
+var ErrGovernanceNotSupported = errors.New("err consensus doesn't support governance transactions")
+var ErrStaleGovernance = errors.New("err governance transaction is proposed on top of another block")
+var ErrNoQuorum = errors.New("err governance transaction isn't signed by a majority of the signers")
+
+// PoAConsensus is a proof of authority: the signers take turns sealing blocks
+// with their wallet keys, the signer of a block being the one at the block's
+// height modulo the number of signers. The signer set is changed by governance
+// transactions signed by a majority of the current signers, a new set applies
+// from the block after the one including it. Every block weighs the same, so
+// the longest chain is the main one.
+type PoAConsensus struct {
+	signers [][]byte
+	wallet  *Wallet
+
+	mu sync.Mutex
+	// snapshots holds the signer set in force after the block with the hash
+	snapshots map[string][][]byte
+}
+
+// NewPoAConsensus returns the proof of authority with the initial signer
+// addresses. Blocks are sealed with the wallet, which may be nil for nodes
+// only verifying blocks.
+func NewPoAConsensus(signers []string, wallet *Wallet) (*PoAConsensus, error) {
+	hashes, err := signerHashes(signers)
+	if err != nil {
+		return nil, err
+	}
+	return newPoAConsensus(hashes, wallet), nil
+}
+
+func newPoAConsensus(signers [][]byte, wallet *Wallet) *PoAConsensus {
+	return &PoAConsensus{signers: signers, wallet: wallet, snapshots: make(map[string][][]byte)}
+}
+
+// Prepare fails unless the wallet's key is the one in turn for the block.
+func (c *PoAConsensus) Prepare(chain ChainReader, block *Block) error {
+	if c.wallet == nil {
+		return ErrUnauthorizedSigner
+	}
+	if err := prepareTimestamp(chain, &block.BlockHeader); err != nil {
+		return err
+	}
+	signers, err := c.signersAfter(chain, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	if err = checkTurn(signers, c.wallet.PublicKey, block.Height); err != nil {
+		return err
+	}
+	if err = checkBlockGovernance(signers, block); err != nil {
+		return err
+	}
+	block.Bits = 0
+	block.Nonce = 0
+	block.Signer = c.wallet.PublicKey
+	return nil
+}
+
+func (c *PoAConsensus) Seal(ctx context.Context, block *Block) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.wallet == nil {
+		return ErrUnauthorizedSigner
+	}
+	signature, err := signHash(&c.wallet.PrivateKey, block.SealHash())
+	if err != nil {
+		return err
+	}
+	block.Signature = signature
+	block.Hash = block.BlockHeader.Hash()
+	return nil
+}
+
+func (c *PoAConsensus) Verify(chain ChainReader, block *Block) error {
+	if block.Bits != 0 || block.Nonce != 0 || !bytes.Equal(block.Hash, block.BlockHeader.Hash()) {
+		return ErrInvalidSeal
+	}
+	if !verifyHash(block.Signer, block.SealHash(), block.Signature) {
+		return ErrInvalidSeal
+	}
+	signers, err := c.signersAfter(chain, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	if err = checkTurn(signers, block.Signer, block.Height); err != nil {
+		return err
+	}
+	return checkBlockGovernance(signers, block)
+}
+
+func (c *PoAConsensus) Weight(block *Block) *big.Int {
+	return big.NewInt(1)
+}
+
+// governanceQuorum returns how many of the signers in force on top of the
+// block with the hash signed the transaction and how many have to.
+func (c *PoAConsensus) governanceQuorum(chain ChainReader, prevBlockHash []byte, tx *Transaction) (int, int, error) {
+	signers, err := c.signersAfter(chain, prevBlockHash)
+	if err != nil {
+		return 0, 0, err
+	}
+	return quorum(signers, tx)
+}
+
+// signersAfter returns the signer set in force after the block with the hash,
+// replaying governance transactions back from the last known snapshot.
+func (c *PoAConsensus) signersAfter(chain ChainReader, hash []byte) ([][]byte, error) {
+	var blocks []*Block
+	signers := c.signers
+	for len(hash) > 0 {
+		c.mu.Lock()
+		snapshot, ok := c.snapshots[hex.EncodeToString(hash)]
+		c.mu.Unlock()
+		if ok {
+			signers = snapshot
+			break
+		}
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+		hash = block.PrevBlockHash
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		for _, tx := range blocks[i].Transactions {
+			if tx.IsGovernance() {
+				signers = governanceSigners(tx)
+			}
+		}
+		c.snapshots[hex.EncodeToString(blocks[i].Hash)] = signers
+	}
+	return signers, nil
+}
+
+func checkTurn(signers [][]byte, pubKey []byte, height int) error {
+	pubKeyHash, err := HashPubKey(pubKey)
+	if err != nil {
+		return err
+	}
+	if !containsHash(signers, pubKeyHash) {
+		return ErrUnauthorizedSigner
+	}
+	if !bytes.Equal(signers[height%len(signers)], pubKeyHash) {
+		return ErrOutOfTurnSigner
+	}
+	return nil
+}
+
+// checkBlockGovernance checks the governance transactions of a block against
+// its parent and the signer set in force before it.
+func checkBlockGovernance(signers [][]byte, block *Block) error {
+	for _, tx := range block.Transactions {
+		if !tx.IsGovernance() {
+			continue
+		}
+		if !bytes.Equal(tx.Vin[0].Txid, block.PrevBlockHash) {
+			return ErrStaleGovernance
+		}
+		signed, required, err := quorum(signers, tx)
+		if err != nil {
+			return err
+		}
+		if signed < required {
+			return ErrNoQuorum
+		}
+	}
+	return nil
+}
+
+// quorum returns how many of the signers signed the governance transaction and
+// how many have to, failing if anyone else signed it.
+func quorum(signers [][]byte, tx *Transaction) (int, int, error) {
+	_, pubKeys, err := governanceSignatures(tx)
+	if err != nil {
+		return 0, 0, ErrIncorrectTransaction
+	}
+	for _, pubKey := range pubKeys {
+		pubKeyHash, err := HashPubKey(pubKey)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !containsHash(signers, pubKeyHash) {
+			return 0, 0, ErrUnauthorizedSigner
+		}
+	}
+	return len(pubKeys), len(signers)/2 + 1, nil
+}
+
+func containsHash(hashes [][]byte, hash []byte) bool {
+	for _, h := range hashes {
+		if bytes.Equal(h, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func signerHashes(signers []string) ([][]byte, error) {
+	if len(signers) == 0 {
+		return nil, ErrIncorrectTransaction
+	}
+	var hashes [][]byte
+	for _, signer := range signers {
+		hash, err := pubKeyHashFromAddress(signer)
+		if err != nil {
+			return nil, err
+		}
+		if containsHash(hashes, hash) {
+			return nil, ErrIncorrectTransaction
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// NewGovernanceTX proposes a new signer set in the given order for the block
+// on top of the one with the hash, signed by the wallet. The transaction is
+// accepted once a majority of the current signers signed it, the others adding
+// their signatures with SignGovernanceTX. Every signer gets a zero value output
+// locked to its address, these outputs are never added to the UTXO set.
+func NewGovernanceTX(wallet *Wallet, signers []string, prevBlockHash []byte) (*Transaction, error) {
+	hashes, err := signerHashes(signers)
+	if err != nil {
+		return nil, err
+	}
+	if len(prevBlockHash) == 0 {
+		return nil, ErrStaleGovernance
+	}
+	tx := Transaction{Vin: []TXInput{{Txid: prevBlockHash, Vout: governanceVout}}}
+	for _, hash := range hashes {
+		tx.Vout = append(tx.Vout, TXOutput{Value: 0, LockingScript: PayToPubKeyHashScript(hash)})
+	}
+	if err = SignGovernanceTX(&tx, wallet); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// SignGovernanceTX adds the signature of the wallet's key to the governance
+// transaction, keeping the ones it already has.
+func SignGovernanceTX(tx *Transaction, wallet *Wallet) error {
+	if !tx.IsGovernance() {
+		return ErrIncorrectTransaction
+	}
+	signatures, pubKeys, err := governanceSignatures(tx)
+	if err != nil {
+		return err
+	}
+	for _, pubKey := range pubKeys {
+		if bytes.Equal(pubKey, wallet.PublicKey) {
+			return nil
+		}
+	}
+	hash, err := governanceHash(tx)
+	if err != nil {
+		return err
+	}
+	signature, err := signHash(&wallet.PrivateKey, hash)
+	if err != nil {
+		return err
+	}
+	b := NewScriptBuilder()
+	for i := range signatures {
+		b.AddData(signatures[i]).AddData(pubKeys[i])
+	}
+	tx.Vin[0].UnlockingScript = b.AddData(signature).AddData(wallet.PublicKey).Script()
+	tx.ID, err = tx.Hash()
+	return err
+}
+
+func (tx Transaction) IsGovernance() bool {
+	return len(tx.Vin) == 1 && tx.Vin[0].Vout == governanceVout
+}
+
+// checkGovernanceTX checks a governance transaction to be included on top of
+// the block with the hash: the proposed signers and the signatures. Whether the
+// signers are authorized and enough is up to the consensus engine.
+func checkGovernanceTX(tx *Transaction, prevBlockHash []byte) error {
+	if !bytes.Equal(tx.Vin[0].Txid, prevBlockHash) {
+		return ErrStaleGovernance
+	}
+	if len(tx.Vout) == 0 {
+		return ErrIncorrectTransaction
+	}
+	var signers [][]byte
+	for _, out := range tx.Vout {
+		signer := payToPubKeyHash(out.LockingScript)
+		if out.Value != 0 || signer == nil || containsHash(signers, signer) {
+			return ErrIncorrectTransaction
+		}
+		signers = append(signers, signer)
+	}
+	signatures, pubKeys, err := governanceSignatures(tx)
+	if err != nil || len(signatures) == 0 {
+		return ErrIncorrectTransaction
+	}
+	hash, err := governanceHash(tx)
+	if err != nil {
+		return err
+	}
+	for i, signature := range signatures {
+		if !verifyHash(pubKeys[i], hash, signature) {
+			return ErrInvalidSignature
+		}
+	}
+	return nil
+}
+
+// governanceSignatures splits the unlocking script of a governance transaction
+// into the signatures and the public keys, each key signing once.
+func governanceSignatures(tx *Transaction) ([][]byte, [][]byte, error) {
+	data, err := pushedData(tx.Vin[0].UnlockingScript)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data)%2 != 0 {
+		return nil, nil, ErrInvalidScript
+	}
+	var signatures, pubKeys [][]byte
+	for i := 0; i < len(data); i += 2 {
+		for _, pubKey := range pubKeys {
+			if bytes.Equal(pubKey, data[i+1]) {
+				return nil, nil, ErrInvalidScript
+			}
+		}
+		signatures = append(signatures, data[i])
+		pubKeys = append(pubKeys, data[i+1])
+	}
+	return signatures, pubKeys, nil
+}
+
+// governanceHash is the hash of the transaction without signatures, which
+// every signer signs.
+func governanceHash(tx *Transaction) ([]byte, error) {
+	unsigned := Transaction{Vin: []TXInput{{Txid: tx.Vin[0].Txid, Vout: governanceVout}}, Vout: tx.Vout}
+	return unsigned.Hash()
+}
+
+func governanceSigners(tx *Transaction) [][]byte {
+	var signers [][]byte
+	for _, out := range tx.Vout {
+		signers = append(signers, payToPubKeyHash(out.LockingScript))
+	}
+	return signers
+}
+
+// checkGovernance checks a pooled governance transaction with the consensus
+// engine, failing if the engine doesn't support them, the transaction isn't
+// proposed on top of the tip or it lacks signatures.
+func (bc *Blockchain) checkGovernance(tx *Transaction) error {
+	signed, required, err := bc.GovernanceSignatures(tx)
+	if err != nil {
+		return err
+	}
+	if signed < required {
+		return ErrNoQuorum
+	}
+	return nil
+}
+
+// GovernanceSignatures returns how many of the current signers signed the
+// governance transaction proposed on top of the tip and how many have to.
+func (bc *Blockchain) GovernanceSignatures(tx *Transaction) (int, int, error) {
+	g, ok := bc.consensus.(governor)
+	if !ok {
+		return 0, 0, ErrGovernanceNotSupported
+	}
+	tip := bc.Tip()
+	if err := checkGovernanceTX(tx, tip); err != nil {
+		return 0, 0, err
+	}
+	return g.governanceQuorum(bc, tip, tx)
+}
+
+// governor is implemented by consensus engines accepting governance
+// transactions.
+type governor interface {
+	governanceQuorum(chain ChainReader, prevBlockHash []byte, tx *Transaction) (int, int, error)
+}
@@ -0,0 +1,188 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type testChain map[string]*Block
+
+func (c testChain) GetHeader(hash []byte) (*BlockHeader, error) {
+	block, err := c.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &block.BlockHeader, nil
+}
+
+func (c testChain) GetBlock(hash []byte) (*Block, error) {
+	block, ok := c[hex.EncodeToString(hash)]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return block, nil
+}
+
+func TestPoAConsensus(t *testing.T) {
+	wallets := make([]*Wallet, 3)
+	addresses := make([]string, 3)
+	for i := range wallets {
+		var err error
+		wallets[i], err = CreateWallet()
+		require.NoError(t, err)
+		address, err := wallets[i].GetAddress()
+		require.NoError(t, err)
+		addresses[i] = string(address)
+	}
+	engines := make([]*PoAConsensus, 3)
+	for i := range engines {
+		var err error
+		engines[i], err = NewPoAConsensus(addresses[:2], wallets[i])
+		require.NoError(t, err)
+	}
+	verifier, err := NewPoAConsensus(addresses[:2], nil)
+	require.NoError(t, err)
+
+	chain := testChain{}
+	var tip []byte
+	seal := func(signer int, height int, txs ...*Transaction) *Block {
+		cb, err := CreateCoinbaseTX(addresses[signer], "", 0)
+		require.NoError(t, err)
+		block := NewBlock(append([]*Transaction{cb}, txs...), tip, height)
+		require.NoError(t, engines[signer].Prepare(chain, block))
+		require.NoError(t, engines[signer].Seal(context.Background(), block))
+		return block
+	}
+	add := func(block *Block) {
+		require.NoError(t, verifier.Verify(chain, block))
+		chain[hex.EncodeToString(block.Hash)] = block
+		tip = block.Hash
+	}
+
+	add(seal(0, 0))
+	require.ErrorIs(t, engines[0].Prepare(chain, NewBlock(nil, tip, 1)), ErrOutOfTurnSigner)
+	require.ErrorIs(t, engines[2].Prepare(chain, NewBlock(nil, tip, 1)), ErrUnauthorizedSigner)
+
+	block := seal(1, 1)
+	block.Timestamp++
+	require.ErrorIs(t, verifier.Verify(chain, block), ErrInvalidSeal)
+	block = seal(1, 1)
+	block.Signer = wallets[2].PublicKey
+	require.NoError(t, engines[2].Seal(context.Background(), block))
+	require.ErrorIs(t, verifier.Verify(chain, block), ErrUnauthorizedSigner)
+	add(seal(1, 1))
+
+	unauthorized, err := NewGovernanceTX(wallets[2], addresses[2:], tip)
+	require.NoError(t, err)
+	require.NoError(t, checkGovernanceTX(unauthorized, tip))
+	block = NewBlock([]*Transaction{unauthorized}, tip, 2)
+	require.ErrorIs(t, engines[0].Prepare(chain, block), ErrUnauthorizedSigner)
+
+	governance, err := NewGovernanceTX(wallets[0], []string{addresses[2], addresses[1]}, tip)
+	require.NoError(t, err)
+	tampered := *governance
+	tampered.Vout = []TXOutput{governance.Vout[1], governance.Vout[0]}
+	require.ErrorIs(t, checkGovernanceTX(&tampered, tip), ErrInvalidSignature)
+	rebound := *governance
+	rebound.Vin = []TXInput{{Txid: chain[hex.EncodeToString(tip)].PrevBlockHash, Vout: governanceVout, UnlockingScript: governance.Vin[0].UnlockingScript}}
+	require.ErrorIs(t, checkGovernanceTX(&rebound, rebound.Vin[0].Txid), ErrInvalidSignature)
+
+	// one of the two signers can't replace the set on its own, signing twice
+	// doesn't count
+	require.NoError(t, checkGovernanceTX(governance, tip))
+	require.ErrorIs(t, engines[0].Prepare(chain, NewBlock([]*Transaction{governance}, tip, 2)), ErrNoQuorum)
+	require.NoError(t, SignGovernanceTX(governance, wallets[0]))
+	require.ErrorIs(t, engines[0].Prepare(chain, NewBlock([]*Transaction{governance}, tip, 2)), ErrNoQuorum)
+	duplicated := *governance
+	duplicated.Vin = []TXInput{governance.Vin[0]}
+	duplicated.Vin[0].UnlockingScript = append(append([]byte{}, governance.Vin[0].UnlockingScript...), governance.Vin[0].UnlockingScript...)
+	require.ErrorIs(t, checkGovernanceTX(&duplicated, tip), ErrIncorrectTransaction)
+	cosigned := *governance
+	cosigned.Vin = []TXInput{governance.Vin[0]}
+	require.NoError(t, SignGovernanceTX(&cosigned, wallets[2]))
+	require.NoError(t, checkGovernanceTX(&cosigned, tip))
+	require.ErrorIs(t, engines[0].Prepare(chain, NewBlock([]*Transaction{&cosigned}, tip, 2)), ErrUnauthorizedSigner)
+	require.NoError(t, SignGovernanceTX(governance, wallets[1]))
+
+	add(seal(0, 2, governance))
+	require.ErrorIs(t, engines[0].Prepare(chain, NewBlock(nil, tip, 3)), ErrUnauthorizedSigner)
+	require.ErrorIs(t, checkGovernanceTX(governance, tip), ErrStaleGovernance)
+	add(seal(1, 3))
+	// replaying the proposal later on is rejected even if its proposer signs
+	block = seal(2, 4)
+	block.Transactions = append(block.Transactions, governance)
+	require.ErrorIs(t, engines[2].Prepare(chain, block), ErrStaleGovernance)
+	add(seal(2, 4))
+}
+
+func TestPoABlockchain(t *testing.T) {
+	SetDataDir(t.TempDir())
+	SetNetwork(&RegTestParams)
+	t.Cleanup(func() {
+		SetNetwork(&MainNetParams)
+	})
+	first, firstAddress := newTestAddress(t)
+	second, secondAddress := newTestAddress(t)
+	genesisSealer, err := NewPoAConsensus([]string{firstAddress, secondAddress}, first)
+	require.NoError(t, err)
+	_, err = CreateBlockchainWithConsensus(firstAddress, genesisSealer)
+	require.NoError(t, err)
+
+	// the engine is rebuilt from the stored parameters
+	_, err = GetBlockchainWithConsensus(NewPoWConsensus(nil))
+	require.ErrorIs(t, err, ErrConsensusMismatch)
+	others, err := NewPoAConsensus([]string{secondAddress}, second)
+	require.NoError(t, err)
+	_, err = GetBlockchainWithConsensus(others)
+	require.ErrorIs(t, err, ErrConsensusMismatch)
+	bc, err := GetBlockchainWithSealer(nil, func() (*Wallet, error) {
+		return second, nil
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, bc.db.Close())
+	})
+	require.Equal(t, paramsOf(genesisSealer), paramsOf(bc.consensus))
+
+	mempool := NewMempool(bc)
+	governance, err := NewGovernanceTX(first, []string{secondAddress}, bc.Tip())
+	require.NoError(t, err)
+	signed, required, err := bc.GovernanceSignatures(governance)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, []int{signed, required})
+	require.ErrorIs(t, mempool.Add(governance), ErrNoQuorum)
+	require.NoError(t, SignGovernanceTX(governance, second))
+	require.NoError(t, mempool.Add(governance))
+	block, err := mempool.AssembleBlock(context.Background(), secondAddress, maxBlockTransactions)
+	require.NoError(t, err)
+	require.Len(t, block.Transactions, 2)
+	require.Equal(t, 0, mempool.Len())
+
+	// the proposal can't be replayed on top of the new tip
+	require.ErrorIs(t, mempool.Add(governance), ErrStaleGovernance)
+	stale := NewBlock([]*Transaction{governance}, bc.Tip(), block.Height+1)
+	require.ErrorIs(t, bc.consensus.Prepare(bc, stale), ErrStaleGovernance)
+
+	// pending proposals expire with the next block
+	pending, err := NewGovernanceTX(second, []string{firstAddress, secondAddress}, bc.Tip())
+	require.NoError(t, err)
+	require.NoError(t, mempool.Add(pending))
+	cb, err := CreateCoinbaseTX(secondAddress, "", 0)
+	require.NoError(t, err)
+	block, err = bc.MineBlock(context.Background(), []*Transaction{cb})
+	require.NoError(t, err)
+	mempool.Evict(block)
+	require.Equal(t, 0, mempool.Len())
+	require.NoError(t, bc.Validate(context.Background()))
+
+	// the outputs of a governance transaction can't be spent
+	spend := &Transaction{
+		Vin:  []TXInput{{Txid: governance.ID, Vout: 0}},
+		Vout: []TXOutput{newTestOutput(t, 0, secondAddress)},
+	}
+	require.NoError(t, bc.SignTransaction(spend, second.PrivateKey))
+	storeBlock(t, bc, mineOn(t, bc, block, secondAddress, spend))
+	requireInvalidBlock(t, bc, block.Height+1, ErrTransactionNotFound)
+}
@@ -2,65 +2,107 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"fmt"
-	"math"
 	"math/big"
 )
 
-const targetBits = 24
-
-var maxNonce = math.MaxInt64
-
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
 }
 
-func NewProofOfWork(block *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+// PoWConsensus is the SHA-256 proof of work, the weight of a block being the
+// expected number of hashes needed to find it.
+type PoWConsensus struct {
+	miner *Miner
+}
 
-	return &ProofOfWork{block: block, target: target}
+// NewPoWConsensus returns the proof of work sealing blocks with the miner, or
+// with all the CPUs if miner is nil.
+func NewPoWConsensus(miner *Miner) *PoWConsensus {
+	if miner == nil {
+		miner = NewMiner(0)
+	}
+	return &PoWConsensus{miner: miner}
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
+func (c *PoWConsensus) Prepare(chain ChainReader, block *Block) error {
+	if err := prepareTimestamp(chain, &block.BlockHeader); err != nil {
+		return err
+	}
+	bits, err := requiredBits(chain, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	block.Bits = bits
+	return nil
+}
 
-	fmt.Printf("Mining a new block")
-	for nonce < maxNonce {
-		data := pow.prepareData(nonce)
-		hash = sha256.Sum256(data)
-		hashInt.SetBytes(hash[:])
+func (c *PoWConsensus) Seal(ctx context.Context, block *Block) error {
+	return c.miner.Mine(ctx, block)
+}
 
-		if hashInt.Cmp(pow.target) == -1 {
-			fmt.Printf("%dth iteration: %x", nonce, hash)
-			break
-		} else {
-			nonce++
+func (c *PoWConsensus) Verify(chain ChainReader, block *Block) error {
+	bits, err := requiredBits(chain, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	// the target is only built for the required bits, other values may not
+	// even fit a 256 bit target
+	if block.Bits != bits || bits < minTargetBits || bits > maxTargetBits {
+		return ErrInvalidProofOfWork
+	}
+	if !NewProofOfWork(block).Validate(bits) {
+		return ErrInvalidProofOfWork
+	}
+	for _, tx := range block.Transactions {
+		if tx.IsGovernance() {
+			return ErrGovernanceNotSupported
 		}
 	}
-	fmt.Printf("\n\n")
-	return nonce, hash[:]
+	return nil
+}
+
+func (c *PoWConsensus) Weight(block *Block) *big.Int {
+	return BlockWork(block)
 }
 
-func (pow *ProofOfWork) Validate() bool {
+func NewProofOfWork(block *Block) *ProofOfWork {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-block.Bits))
+
+	return &ProofOfWork{block: block, target: target}
+}
+
+// Validate checks that the block carries the difficulty required by the chain
+// rules and that its hash is correct and meets the target.
+func (pow *ProofOfWork) Validate(requiredBits int) bool {
+	if pow.block.Bits != requiredBits {
+		return false
+	}
 	var hashInt big.Int
 	data := pow.prepareData(pow.block.Nonce)
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 
-	return hashInt.Cmp(pow.target) == -1
+	return bytes.Equal(hash[:], pow.block.Hash) && hashInt.Cmp(pow.target) == -1
 }
 
+// prepareData encodes the block's header with the nonce, the transactions only
+// enter the hash through the header's merkle root.
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	return bytes.Join([][]byte{
-		pow.block.PrevBlockHash,
-		pow.block.HashTransactions(),
-		IntToHex(pow.block.Timestamp),
-		IntToHex(int64(targetBits)),
-		IntToHex(int64(nonce)),
-	}, []byte{})
+	header := pow.block.BlockHeader
+	header.Nonce = nonce
+	var e encoder
+	encodeHeader(&e, &header)
+	return e.buf
+}
+
+// BlockWork is the expected number of hashes needed to find a block meeting
+// the block's target.
+func BlockWork(block *Block) *big.Int {
+	target := NewProofOfWork(block).target
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
 }
@@ -0,0 +1,544 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+const jsonRPCVersion = "2.0"
+
+// error codes defined by the JSON-RPC 2.0 specification, rpcServerError is
+// returned for failures of the called method
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+const maxRPCRequestSize = 1 << 20
+
+// maxGenerateBlocks caps the blocks a single generate call mines
+const maxGenerateBlocks = 1000
+
+var ErrGenerateNotAllowed = errors.New("err generate is only available on regtest")
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// rpcHandler runs a method, the context being done once the client is gone.
+type rpcHandler func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// RPCServer serves JSON-RPC 2.0 requests over HTTP. All requests share a single
+// blockchain and mempool, calls touching the wallet file or mining a block are
+// handled one at a time.
+type RPCServer struct {
+	log     *logrus.Logger
+	bc      *Blockchain
+	mempool *Mempool
+	token   string
+	mu      sync.Mutex
+	methods map[string]rpcHandler
+}
+
+type AddressParams struct {
+	Address string `json:"address"`
+}
+
+type SendParams struct {
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Amount        int    `json:"amount"`
+	Fee           int    `json:"fee"`
+	Miner         string `json:"miner,omitempty"`
+	Passphrase    string `json:"passphrase,omitempty"`
+	CoinSelection string `json:"coinselection,omitempty"`
+}
+
+type SendManyParams struct {
+	From          string      `json:"from"`
+	Recipients    []Recipient `json:"recipients"`
+	Fee           int         `json:"fee"`
+	Miner         string      `json:"miner,omitempty"`
+	Passphrase    string      `json:"passphrase,omitempty"`
+	CoinSelection string      `json:"coinselection,omitempty"`
+}
+
+// BlockParams select a block either by hash or by main chain height.
+type BlockParams struct {
+	Hash   string `json:"hash,omitempty"`
+	Height *int   `json:"height,omitempty"`
+}
+
+type TxIDParams struct {
+	TxID string `json:"txid"`
+}
+
+type GenerateParams struct {
+	Blocks  int    `json:"blocks"`
+	Address string `json:"address"`
+}
+
+type WalletParams struct {
+	// HD defaults to true, keys are only random if it's false
+	HD         *bool  `json:"hd,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+type SendResult struct {
+	TxID  string `json:"txid"`
+	Block string `json:"block"`
+}
+
+type CreateWalletResult struct {
+	Address  string `json:"address"`
+	Mnemonic string `json:"mnemonic,omitempty"`
+}
+
+// BlockResult and TransactionResult are the JSON views of blocks and
+// transactions, binary fields are hex encoded.
+type BlockResult struct {
+	Hash          string              `json:"hash"`
+	Version       int                 `json:"version"`
+	PrevBlockHash string              `json:"prevblockhash"`
+	Height        int                 `json:"height"`
+	Timestamp     int64               `json:"timestamp"`
+	Bits          int                 `json:"bits"`
+	Nonce         int                 `json:"nonce"`
+	MerkleRoot    string              `json:"merkleroot"`
+	Transactions  []TransactionResult `json:"transactions"`
+}
+
+type TransactionResult struct {
+	ID        string         `json:"txid"`
+	Vin       []InputResult  `json:"vin"`
+	Vout      []OutputResult `json:"vout"`
+	LockTime  int            `json:"locktime"`
+	Confirmed bool           `json:"confirmed"`
+}
+
+type InputResult struct {
+	Txid   string `json:"txid"`
+	Vout   int    `json:"vout"`
+	Script string `json:"script"`
+}
+
+// OutputResult holds the disassembled locking script and, for the standard
+// scripts, the address it pays to.
+type OutputResult struct {
+	Value   int    `json:"value"`
+	Address string `json:"address,omitempty"`
+	Script  string `json:"script"`
+}
+
+func NewRPCServer(log *logrus.Logger, bc *Blockchain, token string) *RPCServer {
+	s := &RPCServer{log: log, bc: bc, mempool: NewMempool(bc), token: token}
+	s.methods = map[string]rpcHandler{
+		"getbalance":     s.getBalance,
+		"send":           s.send,
+		"sendmany":       s.sendMany,
+		"getblock":       s.getBlock,
+		"gettransaction": s.getTransaction,
+		"getblockcount":  s.getBlockCount,
+		"generate":       s.generate,
+		"listaddresses":  s.listAddresses,
+		"createwallet":   s.createWallet,
+	}
+	return s
+}
+
+func (s *RPCServer) ListenAndServe(address string) error {
+	s.log.Infof("rpc server listening on %s", address)
+	return http.ListenAndServe(address, s)
+}
+
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.token != "" {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRPCRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var response interface{}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var requests []json.RawMessage
+		if err = json.Unmarshal(body, &requests); err != nil || len(requests) == 0 {
+			response = errorResponse(nil, rpcInvalidRequest, "invalid batch")
+		} else {
+			var responses []*rpcResponse
+			for _, request := range requests {
+				if resp := s.handle(r.Context(), request); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				response = responses
+			}
+		}
+	} else if resp := s.handle(r.Context(), body); resp != nil {
+		response = resp
+	}
+
+	// nothing is returned for notifications
+	if response == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(response); err != nil {
+		s.log.Warnf("err writing rpc response: %s", err)
+	}
+}
+
+// handle runs a single request, returning nil for notifications.
+func (s *RPCServer) handle(ctx context.Context, data []byte) *rpcResponse {
+	var request rpcRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return errorResponse(nil, rpcParseError, err.Error())
+	}
+	if request.JSONRPC != jsonRPCVersion || request.Method == "" {
+		return errorResponse(request.ID, rpcInvalidRequest, "invalid request")
+	}
+	handler, ok := s.methods[request.Method]
+	if !ok {
+		if request.ID == nil {
+			return nil
+		}
+		return errorResponse(request.ID, rpcMethodNotFound, "method not found")
+	}
+	result, err := handler(ctx, request.Params)
+	if request.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *RPCError
+		if errors.As(err, &rpcErr) {
+			return errorResponse(request.ID, rpcErr.Code, rpcErr.Message)
+		}
+		return errorResponse(request.ID, rpcServerError, err.Error())
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(request.ID, rpcServerError, err.Error())
+	}
+	return &rpcResponse{JSONRPC: jsonRPCVersion, Result: encoded, ID: request.ID}
+}
+
+func errorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: jsonRPCVersion, Error: &RPCError{Code: code, Message: message}, ID: id}
+}
+
+// decodeParams reads by-name params, missing params leave v untouched.
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &RPCError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func invalidParams(message string) error {
+	return &RPCError{Code: rpcInvalidParams, Message: message}
+}
+
+func (s *RPCServer) getBalance(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AddressParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Address == "" {
+		return nil, invalidParams("address is required")
+	}
+	return s.bc.GetBalance(p.Address)
+}
+
+func (s *RPCServer) send(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p SendParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.From == "" || p.To == "" || p.Amount <= 0 || p.Fee < 0 {
+		return nil, invalidParams("from, to and a positive amount are required")
+	}
+	selector, err := coinSelectorParam(p.CoinSelection)
+	if err != nil {
+		return nil, err
+	}
+	return s.sendTransaction(ctx, p.From, p.Miner, p.Passphrase, func(wallet *Wallet) (*Transaction, error) {
+		return CreateUTXOTransaction(wallet, p.To, p.Amount, p.Fee, selector, s.bc)
+	})
+}
+
+func (s *RPCServer) sendMany(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p SendManyParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.From == "" || len(p.Recipients) == 0 || p.Fee < 0 {
+		return nil, invalidParams("from and recipients are required")
+	}
+	selector, err := coinSelectorParam(p.CoinSelection)
+	if err != nil {
+		return nil, err
+	}
+	return s.sendTransaction(ctx, p.From, p.Miner, p.Passphrase, func(wallet *Wallet) (*Transaction, error) {
+		return CreateSendManyTransaction(wallet, p.Recipients, p.Fee, selector, s.bc)
+	})
+}
+
+// coinSelectorParam resolves the optional coin selection param, nil standing
+// for the default strategy.
+func coinSelectorParam(name string) (CoinSelector, error) {
+	if name == "" {
+		return nil, nil
+	}
+	selector, err := CoinSelectorByName(name)
+	if err != nil {
+		return nil, invalidParams(err.Error())
+	}
+	return selector, nil
+}
+
+// sendTransaction creates a transaction spending from the wallet of the from
+// address and mines it in a block paying the reward to the miner, which
+// defaults to the from address.
+func (s *RPCServer) sendTransaction(ctx context.Context, from, miner, passphrase string, create func(wallet *Wallet) (*Transaction, error)) (interface{}, error) {
+	if miner == "" {
+		miner = from
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wallets, err := LoadWallets(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := create(wallet)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.mempool.Add(tx); err != nil {
+		return nil, err
+	}
+	block, err := s.mempool.AssembleBlock(ctx, miner, maxBlockTransactions)
+	if err != nil {
+		s.mempool.Remove(tx.ID)
+		return nil, err
+	}
+	return SendResult{TxID: hex.EncodeToString(tx.ID), Block: hex.EncodeToString(block.Hash)}, nil
+}
+
+func (s *RPCServer) getBlock(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p BlockParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Height != nil {
+		hash, err := s.bc.HashByHeight(*p.Height)
+		if err != nil {
+			return nil, err
+		}
+		return s.bc.BlockResult(hash)
+	}
+	hash, err := hex.DecodeString(p.Hash)
+	if err != nil || len(hash) == 0 {
+		return nil, invalidParams("hex encoded hash or height is required")
+	}
+	return s.bc.BlockResult(hash)
+}
+
+func (s *RPCServer) getTransaction(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p TxIDParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	txID, err := hex.DecodeString(p.TxID)
+	if err != nil || len(txID) == 0 {
+		return nil, invalidParams("hex encoded txid is required")
+	}
+	if tx, ok := s.mempool.Get(txID); ok {
+		return newTransactionResult(tx, false), nil
+	}
+	tx, err := s.bc.FindTransaction(txID)
+	if err != nil {
+		return nil, err
+	}
+	return newTransactionResult(tx, true), nil
+}
+
+func (s *RPCServer) getBlockCount(context.Context, json.RawMessage) (interface{}, error) {
+	return s.bc.Height()
+}
+
+func (s *RPCServer) generate(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p GenerateParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if netParams.Name != RegTestParams.Name {
+		return nil, ErrGenerateNotAllowed
+	}
+	if p.Blocks <= 0 || p.Blocks > maxGenerateBlocks || p.Address == "" {
+		return nil, invalidParams(fmt.Sprintf("up to %d blocks and an address are required", maxGenerateBlocks))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes, err := s.bc.Generate(ctx, p.Blocks, p.Address)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(hashes))
+	for i, hash := range hashes {
+		result[i] = hex.EncodeToString(hash)
+	}
+	return result, nil
+}
+
+func (s *RPCServer) listAddresses(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WalletParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wallets, err := LoadWallets(p.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	addresses := wallets.GetAddresses()
+	if addresses == nil {
+		addresses = []string{}
+	}
+	return addresses, nil
+}
+
+func (s *RPCServer) createWallet(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p WalletParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wallets, err := LoadWallets(p.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var result CreateWalletResult
+	if (p.HD == nil || *p.HD) && !wallets.IsHD() {
+		if result.Mnemonic, err = wallets.InitMnemonic(); err != nil {
+			return nil, err
+		}
+	}
+	if result.Address, err = wallets.CreateWallet(); err != nil {
+		return nil, err
+	}
+	if err = wallets.SaveToFile(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// BlockResult returns the JSON view of the block with the given hash.
+func (bc *Blockchain) BlockResult(hash []byte) (*BlockResult, error) {
+	var result *BlockResult
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		result = newBlockResult(block)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func newBlockResult(block *Block) *BlockResult {
+	result := &BlockResult{
+		Hash:          hex.EncodeToString(block.Hash),
+		Version:       block.Version,
+		PrevBlockHash: hex.EncodeToString(block.PrevBlockHash),
+		Height:        block.Height,
+		Timestamp:     block.Timestamp,
+		Bits:          block.Bits,
+		Nonce:         block.Nonce,
+		MerkleRoot:    hex.EncodeToString(block.HashMerkleRoot),
+	}
+	for _, tx := range block.Transactions {
+		result.Transactions = append(result.Transactions, *newTransactionResult(tx, true))
+	}
+	return result
+}
+
+func newTransactionResult(tx *Transaction, confirmed bool) *TransactionResult {
+	result := &TransactionResult{ID: hex.EncodeToString(tx.ID), LockTime: tx.LockTime, Confirmed: confirmed}
+	for _, vin := range tx.Vin {
+		result.Vin = append(result.Vin, InputResult{
+			Txid:   hex.EncodeToString(vin.Txid),
+			Vout:   vin.Vout,
+			Script: hex.EncodeToString(vin.UnlockingScript),
+		})
+	}
+	for _, out := range tx.Vout {
+		address, _ := scriptAddress(out.LockingScript)
+		result.Vout = append(result.Vout, OutputResult{
+			Value:   out.Value,
+			Address: address,
+			Script:  DisassembleScript(out.LockingScript),
+		})
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const rpcClientTimeout = 5 * time.Minute
+
+// RPCClient calls the methods of an RPCServer.
+type RPCClient struct {
+	url    string
+	token  string
+	client *http.Client
+	nextID int64
+}
+
+// NewRPCClient accepts either a host:port or a full URL of the server.
+func NewRPCClient(address, token string) *RPCClient {
+	url := address
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	return &RPCClient{url: url, token: token, client: &http.Client{Timeout: rpcClientTimeout}}
+}
+
+// Call invokes the method with by-name params decoding its result into result.
+// Errors returned by the server are of type *RPCError.
+func (c *RPCClient) Call(method string, params, result interface{}) error {
+	id, err := json.Marshal(atomic.AddInt64(&c.nextID, 1))
+	if err != nil {
+		return err
+	}
+	request := rpcRequest{JSONRPC: jsonRPCVersion, Method: method, ID: id}
+	if params != nil {
+		if request.Params, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	httpResponse, err := c.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("err rpc server responded with %s", httpResponse.Status)
+	}
+
+	var response rpcResponse
+	if err = json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,94 @@
+package blockchain
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRPCServer(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	server := httptest.NewServer(NewRPCServer(log, nil, "secret"))
+	defer server.Close()
+
+	var rpcErr *RPCError
+	err := NewRPCClient(server.URL, "wrong").Call("getblockcount", nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "401")
+
+	client := NewRPCClient(server.URL, "secret")
+	err = client.Call("nosuchmethod", nil, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	require.Equal(t, rpcMethodNotFound, rpcErr.Code)
+
+	err = client.Call("getbalance", AddressParams{}, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	require.Equal(t, rpcInvalidParams, rpcErr.Code)
+
+	err = client.Call("gettransaction", []int{1}, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	require.Equal(t, rpcInvalidParams, rpcErr.Code)
+
+	post := func(body string) (int, string) {
+		request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		require.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer secret")
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		data, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		return response.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	status, body := post(`{"jsonrpc":"2.0","method":"getbalance"`)
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `"code":-32700`)
+	require.Contains(t, body, `"id":null`)
+
+	status, body = post(`{"jsonrpc":"1.0","method":"getbalance","id":1}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `"code":-32600`)
+
+	status, _ = post(`{"jsonrpc":"2.0","method":"getbalance","params":{}}`)
+	require.Equal(t, http.StatusNoContent, status)
+
+	status, body = post(`[{"jsonrpc":"2.0","method":"getbalance","id":"a"},{"jsonrpc":"2.0","method":"getbalance"},{"jsonrpc":"2.0","method":"x","id":2}]`)
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, strings.HasPrefix(body, "["))
+	require.Contains(t, body, `"id":"a"`)
+	require.Contains(t, body, `"id":2`)
+	require.Equal(t, 2, strings.Count(body, `"jsonrpc"`))
+}
+
+func TestRPCGenerate(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	mainnet := httptest.NewServer(NewRPCServer(log, nil, ""))
+	defer mainnet.Close()
+	var rpcErr *RPCError
+	err := NewRPCClient(mainnet.URL, "").Call("generate", GenerateParams{Blocks: 1, Address: "x"}, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	require.Equal(t, rpcServerError, rpcErr.Code)
+	require.Contains(t, rpcErr.Message, "regtest")
+
+	bc, _, address := newTestChain(t)
+	server := httptest.NewServer(NewRPCServer(log, bc, ""))
+	defer server.Close()
+	client := NewRPCClient(server.URL, "")
+	err = client.Call("generate", GenerateParams{Blocks: maxGenerateBlocks + 1, Address: address}, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	require.Equal(t, rpcInvalidParams, rpcErr.Code)
+
+	var hashes []string
+	require.NoError(t, client.Call("generate", GenerateParams{Blocks: 2, Address: address}, &hashes))
+	require.Len(t, hashes, 2)
+	height, err := bc.Height()
+	require.NoError(t, err)
+	require.Equal(t, 2, height)
+}
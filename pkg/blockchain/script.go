@@ -0,0 +1,346 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Outputs are locked by a script and inputs unlock them with a script of their
+// own. The unlocking script may only push data, the locking script is then run
+// on the resulting stack and succeeds if it leaves a true value on top.
+const (
+	Op0                   = 0x00
+	OpPushData1           = 0x4c
+	OpPushData2           = 0x4d
+	Op1                   = 0x51
+	Op16                  = 0x60
+	OpIf                  = 0x63
+	OpNotIf               = 0x64
+	OpElse                = 0x67
+	OpEndIf               = 0x68
+	OpVerify              = 0x69
+	OpDrop                = 0x75
+	OpDup                 = 0x76
+	OpEqual               = 0x87
+	OpEqualVerify         = 0x88
+	OpHash160             = 0xa9
+	OpCheckSig            = 0xac
+	OpCheckMultisig       = 0xae
+	OpCheckLockTimeVerify = 0xb1
+)
+
+const (
+	maxScriptSize        = 10000
+	maxScriptElementSize = 2048
+	maxStackSize         = 1000
+	// numbers on the stack are limited to 4 bytes, lock times to 5
+	maxScriptNumLen   = 4
+	maxLockTimeNumLen = 5
+)
+
+var ErrInvalidScript = errors.New("err invalid script")
+var ErrScriptFailed = errors.New("err script failed")
+
+var opcodeNames = map[byte]string{
+	Op0:                   "OP_0",
+	OpIf:                  "OP_IF",
+	OpNotIf:               "OP_NOTIF",
+	OpElse:                "OP_ELSE",
+	OpEndIf:               "OP_ENDIF",
+	OpVerify:              "OP_VERIFY",
+	OpDrop:                "OP_DROP",
+	OpDup:                 "OP_DUP",
+	OpEqual:               "OP_EQUAL",
+	OpEqualVerify:         "OP_EQUALVERIFY",
+	OpHash160:             "OP_HASH160",
+	OpCheckSig:            "OP_CHECKSIG",
+	OpCheckMultisig:       "OP_CHECKMULTISIG",
+	OpCheckLockTimeVerify: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+// scriptOp is a parsed instruction, data being set for pushes.
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.opcode <= OpPushData2 || (op.opcode >= Op1 && op.opcode <= Op16)
+}
+
+// parseScript splits the script into instructions. Opcodes below OpPushData1
+// push that many following bytes, OpPushData1 and OpPushData2 read the length
+// from the next one or two little endian bytes.
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > maxScriptSize {
+		return nil, ErrInvalidScript
+	}
+	var ops []scriptOp
+	for len(script) > 0 {
+		opcode := script[0]
+		script = script[1:]
+		n := 0
+		switch {
+		case opcode < OpPushData1:
+			n = int(opcode)
+		case opcode == OpPushData1:
+			if len(script) < 1 {
+				return nil, ErrInvalidScript
+			}
+			n, script = int(script[0]), script[1:]
+		case opcode == OpPushData2:
+			if len(script) < 2 {
+				return nil, ErrInvalidScript
+			}
+			n, script = int(binary.LittleEndian.Uint16(script)), script[2:]
+		}
+		if n > len(script) {
+			return nil, ErrInvalidScript
+		}
+		op := scriptOp{opcode: opcode}
+		if opcode <= OpPushData2 {
+			op.data = script[:n]
+		}
+		ops = append(ops, op)
+		script = script[n:]
+	}
+	return ops, nil
+}
+
+// ScriptBuilder assembles scripts choosing the shortest push for data.
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(opcode byte) *ScriptBuilder {
+	b.script = append(b.script, opcode)
+	return b
+}
+
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch n := len(data); {
+	case n < OpPushData1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OpPushData1, byte(n))
+	default:
+		b.script = append(b.script, OpPushData2, byte(n), byte(n>>8))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+// AddInt pushes the number, with a single opcode from 0 to 16.
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	if n == 0 {
+		return b.AddOp(Op0)
+	}
+	if n >= 1 && n <= 16 {
+		return b.AddOp(byte(Op1 - 1 + n))
+	}
+	return b.AddData(encodeScriptNum(n))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// encodeScriptNum encodes the number little endian, the highest bit of the last
+// byte being the sign.
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	var result []byte
+	for n > 0 {
+		result = append(result, byte(n))
+		n >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+func decodeScriptNum(data []byte, maxLen int) (int64, error) {
+	if len(data) > maxLen {
+		return 0, ErrInvalidScript
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << (8 * i)
+	}
+	last := len(data) - 1
+	if data[last]&0x80 != 0 {
+		return -(n &^ (int64(0x80) << (8 * last))), nil
+	}
+	return n, nil
+}
+
+// PayToPubKeyHashScript locks an output to the key hashing to pubKeyHash:
+// OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG, unlocked by
+// <signature> <public key>.
+func PayToPubKeyHashScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OpDup).AddOp(OpHash160).AddData(pubKeyHash).
+		AddOp(OpEqualVerify).AddOp(OpCheckSig).Script()
+}
+
+// PayToScriptHashScript locks an output to the script hashing to scriptHash:
+// OP_HASH160 <scriptHash> OP_EQUAL. It's unlocked by the data the script
+// needs followed by the script itself, which is run once the hash matched.
+func PayToScriptHashScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OpHash160).AddData(scriptHash).AddOp(OpEqual).Script()
+}
+
+// unlockingScript pushes the signature and the public key spending a pay to
+// public key hash output.
+func unlockingScript(signature, pubKey []byte) []byte {
+	return NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+}
+
+// parseUnlockingScript returns the signature and the public key pushed by the
+// unlocking script of a pay to public key hash output.
+func parseUnlockingScript(script []byte) ([]byte, []byte, error) {
+	data, err := pushedData(script)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) != 2 {
+		return nil, nil, ErrInvalidScript
+	}
+	return data[0], data[1], nil
+}
+
+// matchScript compares the script with a template in which nil data stands for
+// a 20 byte hash, returning the hash.
+func matchScript(script []byte, template []scriptOp) []byte {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != len(template) {
+		return nil
+	}
+	var hash []byte
+	for i, op := range ops {
+		if op.opcode != template[i].opcode {
+			return nil
+		}
+		if template[i].opcode < OpPushData1 && template[i].data == nil {
+			if len(op.data) != 20 {
+				return nil
+			}
+			hash = op.data
+		}
+	}
+	return hash
+}
+
+var (
+	payToPubKeyHashTemplate = []scriptOp{{opcode: OpDup}, {opcode: OpHash160}, {opcode: 20}, {opcode: OpEqualVerify}, {opcode: OpCheckSig}}
+	payToScriptHashTemplate = []scriptOp{{opcode: OpHash160}, {opcode: 20}, {opcode: OpEqual}}
+)
+
+// payToPubKeyHash returns the key hash of a pay to public key hash script, nil
+// for other scripts.
+func payToPubKeyHash(script []byte) []byte {
+	return matchScript(script, payToPubKeyHashTemplate)
+}
+
+// payToScriptHash returns the script hash of a pay to script hash script, nil
+// for other scripts.
+func payToScriptHash(script []byte) []byte {
+	return matchScript(script, payToScriptHashTemplate)
+}
+
+// pushedData returns the data pushed by a push only script.
+func pushedData(script []byte) ([][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	var data [][]byte
+	for _, op := range ops {
+		if !op.isPush() {
+			return nil, ErrInvalidScript
+		}
+		if op.opcode >= Op1 {
+			data = append(data, encodeScriptNum(int64(op.opcode-Op1+1)))
+			continue
+		}
+		data = append(data, op.data)
+	}
+	return data, nil
+}
+
+// scriptAddress returns the address a standard locking script pays to.
+func scriptAddress(script []byte) (string, bool) {
+	if hash := payToPubKeyHash(script); hash != nil {
+		return string(addressFromPubKeyHash(hash)), true
+	}
+	if hash := payToScriptHash(script); hash != nil {
+		return string(encodeAddress(netParams.MultisigVersion, hash)), true
+	}
+	return "", false
+}
+
+// DisassembleScript renders the script as opcode names and hex data.
+func DisassembleScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return "[invalid script]"
+	}
+	parts := make([]string, len(ops))
+	for i, op := range ops {
+		switch {
+		case op.opcode == Op0:
+			parts[i] = opcodeNames[Op0]
+		case op.opcode <= OpPushData2:
+			parts[i] = hex.EncodeToString(op.data)
+		case op.opcode >= Op1 && op.opcode <= Op16:
+			parts[i] = fmt.Sprintf("OP_%d", op.opcode-Op1+1)
+		default:
+			name, ok := opcodeNames[op.opcode]
+			if !ok {
+				name = fmt.Sprintf("OP_UNKNOWN%d", op.opcode)
+			}
+			parts[i] = name
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// isTrue interprets stack data as a boolean, any non zero byte except for the
+// sign bit of the last one making it true.
+func isTrue(data []byte) bool {
+	for i, b := range data {
+		if b != 0 && !(i == len(data)-1 && b == 0x80) {
+			return true
+		}
+	}
+	return false
+}
+
+func boolData(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptNum(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 16, 127, 128, -128, 255, 256, -32768, 1 << 30} {
+		decoded, err := decodeScriptNum(encodeScriptNum(n), maxScriptNumLen)
+		require.NoError(t, err)
+		require.Equal(t, n, decoded)
+	}
+	require.Equal(t, []byte{0x80, 0x00}, encodeScriptNum(128))
+	require.Equal(t, []byte{0x81}, encodeScriptNum(-1))
+	_, err := decodeScriptNum(encodeScriptNum(1<<32), maxScriptNumLen)
+	require.ErrorIs(t, err, ErrInvalidScript)
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	wallet, _ := newTestAddress(t)
+	pubKeyHash, err := HashPubKey(wallet.PublicKey)
+	require.NoError(t, err)
+	locking := PayToPubKeyHashScript(pubKeyHash)
+	require.Equal(t, pubKeyHash, payToPubKeyHash(locking))
+	require.Nil(t, payToScriptHash(locking))
+	require.Equal(t, "OP_DUP OP_HASH160 "+hex.EncodeToString(pubKeyHash)+" OP_EQUALVERIFY OP_CHECKSIG", DisassembleScript(locking))
+
+	hash := sha256.Sum256([]byte("input"))
+	signature, err := signHash(&wallet.PrivateKey, hash[:])
+	require.NoError(t, err)
+	require.NoError(t, verifyScripts(&Transaction{}, unlockingScript(signature, wallet.PublicKey), locking, hash[:]))
+
+	other := sha256.Sum256([]byte("other input"))
+	require.ErrorIs(t, verifyScripts(&Transaction{}, unlockingScript(signature, wallet.PublicKey), locking, other[:]), ErrScriptFailed)
+	thief, _ := newTestAddress(t)
+	require.ErrorIs(t, verifyScripts(&Transaction{}, unlockingScript(signature, thief.PublicKey), locking, hash[:]), ErrScriptFailed)
+
+	// the unlocking script may only push data
+	unlocking := NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).AddOp(OpDup).Script()
+	require.ErrorIs(t, verifyScripts(&Transaction{}, unlocking, locking, hash[:]), ErrInvalidScript)
+}
+
+func TestScriptConditionals(t *testing.T) {
+	tests := []struct {
+		script []byte
+		err    error
+		result bool
+	}{
+		{NewScriptBuilder().AddInt(1).AddOp(OpIf).AddInt(2).AddOp(OpElse).AddInt(0).AddOp(OpEndIf).Script(), nil, true},
+		{NewScriptBuilder().AddInt(0).AddOp(OpIf).AddInt(2).AddOp(OpElse).AddInt(0).AddOp(OpEndIf).Script(), nil, false},
+		{NewScriptBuilder().AddInt(0).AddOp(OpNotIf).AddInt(3).AddOp(OpEndIf).Script(), nil, true},
+		{NewScriptBuilder().AddInt(1).AddOp(OpIf).AddInt(3).Script(), ErrUnbalancedConditional, false},
+		{NewScriptBuilder().AddInt(1).AddOp(OpEndIf).Script(), ErrUnbalancedConditional, false},
+		{NewScriptBuilder().AddInt(5).AddInt(5).AddOp(OpEqual).Script(), nil, true},
+		{NewScriptBuilder().AddInt(5).AddInt(6).AddOp(OpEqualVerify).Script(), ErrScriptFailed, false},
+		{NewScriptBuilder().AddOp(OpDrop).Script(), ErrStackUnderflow, false},
+		{[]byte{0xff}, ErrInvalidScript, false},
+	}
+	for _, test := range tests {
+		vm := scriptVM{tx: &Transaction{}}
+		err := vm.execute(test.script)
+		require.ErrorIs(t, err, test.err, DisassembleScript(test.script))
+		if err == nil {
+			require.Equal(t, test.result, vm.succeeded(), DisassembleScript(test.script))
+		}
+	}
+}
+
+func TestCheckLockTimeVerify(t *testing.T) {
+	wallet, _ := newTestAddress(t)
+	pubKeyHash, err := HashPubKey(wallet.PublicKey)
+	require.NoError(t, err)
+	locking := NewScriptBuilder().AddInt(100).AddOp(OpCheckLockTimeVerify).AddOp(OpDrop).Script()
+	locking = append(locking, PayToPubKeyHashScript(pubKeyHash)...)
+
+	hash := sha256.Sum256([]byte("input"))
+	signature, err := signHash(&wallet.PrivateKey, hash[:])
+	require.NoError(t, err)
+	unlocking := unlockingScript(signature, wallet.PublicKey)
+	require.ErrorIs(t, verifyScripts(&Transaction{LockTime: 99}, unlocking, locking, hash[:]), ErrLockTimeNotReached)
+	require.NoError(t, verifyScripts(&Transaction{LockTime: 100}, unlocking, locking, hash[:]))
+
+	tx := Transaction{LockTime: 100}
+	require.False(t, tx.isFinal(99))
+	require.True(t, tx.isFinal(100))
+}
+
+func TestCheckMultisigKeyOrder(t *testing.T) {
+	wallets := make([]*Wallet, 3)
+	pubKeys := make([][]byte, 3)
+	for i := range wallets {
+		wallets[i], _ = newTestAddress(t)
+		pubKeys[i] = wallets[i].PublicKey
+	}
+	script, err := NewMultisigScript(2, pubKeys)
+	require.NoError(t, err)
+	scriptHash, err := script.Hash()
+	require.NoError(t, err)
+	locking := PayToScriptHashScript(scriptHash)
+
+	hash := sha256.Sum256([]byte("input"))
+	signatures := make([][]byte, 3)
+	for i, wallet := range wallets {
+		signatures[i], err = signHash(&wallet.PrivateKey, hash[:])
+		require.NoError(t, err)
+	}
+	unlocking := NewScriptBuilder().AddData(signatures[0]).AddData(signatures[2]).AddData(script.Serialize()).Script()
+	require.NoError(t, verifyScripts(&Transaction{}, unlocking, locking, hash[:]))
+
+	unlocking = NewScriptBuilder().AddData(signatures[2]).AddData(signatures[0]).AddData(script.Serialize()).Script()
+	require.ErrorIs(t, verifyScripts(&Transaction{}, unlocking, locking, hash[:]), ErrScriptFailed)
+}
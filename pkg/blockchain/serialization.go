@@ -0,0 +1,261 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Blocks and transactions are encoded starting with a version byte followed by
+// their fields in order. Integers are big endian, int fields being stored as
+// int64, byte slices and lists are prefixed with their uint32 length. Neither
+// the transaction ID nor the block hash is encoded, they are the hashes of the
+// transaction and of the block header encodings.
+const (
+	blockEncodingVersion       = byte(4)
+	transactionEncodingVersion = byte(2)
+)
+
+// the smallest possible encodings, used to reject impossible list lengths
+// before allocating
+const (
+	minInputSize       = 4 + 8 + 4
+	minOutputSize      = 8 + 4
+	minTransactionSize = 4 + 1 + 4 + 4 + 8
+)
+
+var ErrMalformedData = errors.New("err malformed serialized data")
+var ErrUnknownVersion = errors.New("err unknown serialization version")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) putByte(v byte) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) putUint32(v uint32) {
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], v)
+}
+
+func (e *encoder) putInt64(v int64) {
+	e.buf = append(e.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], uint64(v))
+}
+
+func (e *encoder) putBytes(v []byte) {
+	e.putUint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// decoder reads the fields written by encoder. After the first failure all
+// reads return zero values and err is kept.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = ErrMalformedData
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	v := d.next(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	v := d.next(4)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (d *decoder) int64() int64 {
+	v := d.next(8)
+	if v == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// int reads an int64 failing if it doesn't fit into int.
+func (d *decoder) int() int {
+	v := d.int64()
+	if int64(int(v)) != v {
+		d.err = ErrMalformedData
+		return 0
+	}
+	return int(v)
+}
+
+// bytes returns a copy of the length prefixed slice, nil if it's empty.
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(d.data)) {
+		d.err = ErrMalformedData
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	return append([]byte{}, d.next(int(n))...)
+}
+
+// count reads a list length checking that the remaining data can hold that many
+// elements of at least minSize bytes.
+func (d *decoder) count(minSize int) int {
+	n := d.uint32()
+	if d.err != nil {
+		return 0
+	}
+	if uint64(n)*uint64(minSize) > uint64(len(d.data)) {
+		d.err = ErrMalformedData
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) version(expected byte) {
+	if v := d.byte(); d.err == nil && v != expected {
+		d.err = fmt.Errorf("%w %d", ErrUnknownVersion, v)
+	}
+}
+
+// finish fails if something is left after the decoded value.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = ErrMalformedData
+	}
+	return d.err
+}
+
+func encodeInput(e *encoder, in *TXInput) {
+	e.putBytes(in.Txid)
+	e.putInt64(int64(in.Vout))
+	e.putBytes(in.UnlockingScript)
+}
+
+func decodeInput(d *decoder) TXInput {
+	return TXInput{Txid: d.bytes(), Vout: d.int(), UnlockingScript: d.bytes()}
+}
+
+func encodeOutput(e *encoder, out *TXOutput) {
+	e.putInt64(int64(out.Value))
+	e.putBytes(out.LockingScript)
+}
+
+func decodeOutput(d *decoder) TXOutput {
+	return TXOutput{Value: d.int(), LockingScript: d.bytes()}
+}
+
+func encodeTransaction(e *encoder, tx *Transaction) {
+	e.putByte(transactionEncodingVersion)
+	e.putUint32(uint32(len(tx.Vin)))
+	for i := range tx.Vin {
+		encodeInput(e, &tx.Vin[i])
+	}
+	e.putUint32(uint32(len(tx.Vout)))
+	for i := range tx.Vout {
+		encodeOutput(e, &tx.Vout[i])
+	}
+	e.putInt64(int64(tx.LockTime))
+}
+
+func decodeTransaction(d *decoder) *Transaction {
+	var tx Transaction
+	d.version(transactionEncodingVersion)
+	if n := d.count(minInputSize); n > 0 {
+		tx.Vin = make([]TXInput, n)
+		for i := range tx.Vin {
+			tx.Vin[i] = decodeInput(d)
+		}
+	}
+	if n := d.count(minOutputSize); n > 0 {
+		tx.Vout = make([]TXOutput, n)
+		for i := range tx.Vout {
+			tx.Vout[i] = decodeOutput(d)
+		}
+	}
+	tx.LockTime = d.int()
+	return &tx
+}
+
+func encodeHeader(e *encoder, h *BlockHeader) {
+	e.putInt64(int64(h.Version))
+	e.putInt64(int64(h.Height))
+	e.putBytes(h.PrevBlockHash)
+	e.putBytes(h.HashMerkleRoot)
+	e.putInt64(h.Timestamp)
+	e.putInt64(int64(h.Bits))
+	e.putInt64(int64(h.Nonce))
+	e.putBytes(h.Signer)
+	e.putBytes(h.Signature)
+}
+
+func decodeHeader(d *decoder) BlockHeader {
+	return BlockHeader{
+		Version:        d.int(),
+		Height:         d.int(),
+		PrevBlockHash:  d.bytes(),
+		HashMerkleRoot: d.bytes(),
+		Timestamp:      d.int64(),
+		Bits:           d.int(),
+		Nonce:          d.int(),
+		Signer:         d.bytes(),
+		Signature:      d.bytes(),
+	}
+}
+
+func encodeBlock(e *encoder, block *Block) {
+	e.putByte(blockEncodingVersion)
+	encodeHeader(e, &block.BlockHeader)
+	e.putUint32(uint32(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		var txEncoder encoder
+		encodeTransaction(&txEncoder, tx)
+		e.putBytes(txEncoder.buf)
+	}
+}
+
+func decodeBlock(d *decoder) (*Block, error) {
+	var block Block
+	d.version(blockEncodingVersion)
+	block.BlockHeader = decodeHeader(d)
+	if n := d.count(minTransactionSize); n > 0 {
+		block.Transactions = make([]*Transaction, n)
+		for i := range block.Transactions {
+			tx, err := DeserializeTransaction(d.bytes())
+			if d.err != nil {
+				return nil, d.err
+			}
+			if err != nil {
+				return nil, err
+			}
+			block.Transactions[i] = tx
+		}
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	block.Hash = block.BlockHeader.Hash()
+	return &block, nil
+}
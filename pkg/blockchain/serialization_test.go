@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func goldenTransaction() *Transaction {
+	return &Transaction{
+		Vin: []TXInput{
+			{Txid: []byte{0xaa, 0xbb}, Vout: 1, UnlockingScript: []byte{0x01, 0x02, 0x03}},
+			{Txid: []byte{0xcc}, Vout: -1},
+		},
+		Vout: []TXOutput{
+			{Value: 10, LockingScript: []byte{0xde, 0xad}},
+			{Value: 0},
+		},
+		LockTime: 5,
+	}
+}
+
+func goldenBlock() *Block {
+	return &Block{
+		BlockHeader: BlockHeader{
+			Version:        1,
+			Height:         5,
+			PrevBlockHash:  []byte{0x01},
+			HashMerkleRoot: []byte{0x02, 0x03},
+			Timestamp:      1600000000,
+			Bits:           24,
+			Nonce:          7,
+			Signer:         []byte{0x05},
+		},
+		Transactions: []*Transaction{goldenTransaction()},
+	}
+}
+
+const (
+	goldenTransactionHex = "02" +
+		"00000002" +
+		"00000002aabb" + "0000000000000001" + "00000003010203" +
+		"00000001cc" + "ffffffffffffffff" + "00000000" +
+		"00000002" +
+		"000000000000000a" + "00000002dead" +
+		"0000000000000000" + "00000000" +
+		"0000000000000005"
+	goldenTransactionID = "51897c5f5d784927c8a0811f00afecc1eb9b367be4fcce7cd8b87d7160eb5a25"
+	goldenHeaderHex     = "0000000000000001" +
+		"0000000000000005" +
+		"0000000101" +
+		"000000020203" +
+		"000000005f5e1000" +
+		"0000000000000018" +
+		"0000000000000007" +
+		"0000000105" +
+		"00000000"
+	goldenHeaderHash = "0060b5f764a64e7ee6287761da1c64e4621dc8ea5af9fd7a1920edc777e08952"
+	goldenBlockHex   = "04" + goldenHeaderHex +
+		"00000001" +
+		"00000051" + goldenTransactionHex
+)
+
+func TestTransactionSerialization(t *testing.T) {
+	tx := goldenTransaction()
+	serialized, err := tx.Serialize()
+	require.NoError(t, err)
+	require.Equal(t, goldenTransactionHex, hex.EncodeToString(serialized))
+
+	id, err := tx.Hash()
+	require.NoError(t, err)
+	require.Equal(t, goldenTransactionID, hex.EncodeToString(id))
+
+	decoded, err := DeserializeTransaction(serialized)
+	require.NoError(t, err)
+	require.Equal(t, id, decoded.ID)
+	reserialized, err := decoded.Serialize()
+	require.NoError(t, err)
+	require.Equal(t, serialized, reserialized)
+
+	in, err := tx.Vin[0].Serialize()
+	require.NoError(t, err)
+	require.Equal(t, "00000002aabb000000000000000100000003010203", hex.EncodeToString(in))
+	decodedIn, err := DeserializeTXInput(in)
+	require.NoError(t, err)
+	require.Equal(t, tx.Vin[0], *decodedIn)
+
+	out, err := tx.Vout[0].Serialize()
+	require.NoError(t, err)
+	require.Equal(t, "000000000000000a00000002dead", hex.EncodeToString(out))
+	decodedOut, err := DeserializeTXOutput(out)
+	require.NoError(t, err)
+	require.Equal(t, tx.Vout[0], *decodedOut)
+}
+
+func TestBlockSerialization(t *testing.T) {
+	serialized, err := goldenBlock().Serialize()
+	require.NoError(t, err)
+	require.Equal(t, goldenBlockHex, hex.EncodeToString(serialized))
+
+	block, err := Deserialize(serialized)
+	require.NoError(t, err)
+	require.Equal(t, goldenHeaderHash, hex.EncodeToString(block.Hash))
+	require.Equal(t, goldenHeaderHash, hex.EncodeToString(block.BlockHeader.Hash()))
+	require.Equal(t, goldenTransactionID, hex.EncodeToString(block.Transactions[0].ID))
+	reserialized, err := block.Serialize()
+	require.NoError(t, err)
+	require.Equal(t, serialized, reserialized)
+}
+
+func TestHeaderSerialization(t *testing.T) {
+	serialized, err := goldenBlock().BlockHeader.Serialize()
+	require.NoError(t, err)
+	require.Equal(t, goldenHeaderHex, hex.EncodeToString(serialized))
+
+	header, err := DeserializeHeader(serialized)
+	require.NoError(t, err)
+	require.Equal(t, goldenBlock().BlockHeader, *header)
+
+	_, err = DeserializeHeader(serialized[:len(serialized)-1])
+	require.ErrorIs(t, err, ErrMalformedData)
+}
+
+func TestMalformedSerialization(t *testing.T) {
+	block, err := hex.DecodeString(goldenBlockHex)
+	require.NoError(t, err)
+	for i := 0; i < len(block); i++ {
+		_, err = Deserialize(block[:i])
+		require.Error(t, err, "truncated at %d", i)
+	}
+	_, err = Deserialize(append(block, 0x00))
+	require.ErrorIs(t, err, ErrMalformedData)
+
+	tx, err := hex.DecodeString(goldenTransactionHex)
+	require.NoError(t, err)
+	_, err = DeserializeTransaction(append([]byte{0x01}, tx[1:]...))
+	require.ErrorIs(t, err, ErrUnknownVersion)
+
+	// the transaction claims more inputs than the data can hold
+	_, err = DeserializeTransaction([]byte{0x02, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00})
+	require.ErrorIs(t, err, ErrMalformedData)
+
+	// the input's txid length points past the end of the data
+	_, err = DeserializeTXInput([]byte{0x00, 0x00, 0x10, 0x00, 0xaa})
+	require.ErrorIs(t, err, ErrMalformedData)
+}
@@ -0,0 +1,602 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	protocol         = "tcp"
+	nodeVersion      = 1
+	commandLength    = 12
+	dialTimeout      = 5 * time.Second
+	messageTimeout   = 30 * time.Second
+	maxMessageSize   = 32 << 20
+	minerTxThreshold = 1
+)
+
+const (
+	invTypeBlock = "block"
+	invTypeTx    = "tx"
+)
+
+var ErrUnknownCommand = errors.New("err unknown command")
+var ErrMessageTooLarge = errors.New("err message too large")
+var ErrChainMismatch = errors.New("err peer is on another chain")
+var ErrNetworkMismatch = errors.New("err peer is on another network")
+
+// messageEncodingVersion starts every payload, which is encoded the way blocks
+// and transactions are, strings as length prefixed bytes.
+const messageEncodingVersion = byte(1)
+
+// message is a payload of the protocol.
+type message interface {
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+type versionMsg struct {
+	Magic      uint32
+	Version    int
+	BestHeight int
+	Genesis    []byte
+	AddrFrom   string
+}
+
+type invMsg struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+type getBlocksMsg struct {
+	AddrFrom string
+}
+
+type getDataMsg struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+type blockMsg struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type txMsg struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+func (m *versionMsg) encode(e *encoder) {
+	e.putUint32(m.Magic)
+	e.putInt64(int64(m.Version))
+	e.putInt64(int64(m.BestHeight))
+	e.putBytes(m.Genesis)
+	e.putBytes([]byte(m.AddrFrom))
+}
+
+func (m *versionMsg) decode(d *decoder) {
+	m.Magic = d.uint32()
+	m.Version = d.int()
+	m.BestHeight = d.int()
+	m.Genesis = d.bytes()
+	m.AddrFrom = string(d.bytes())
+}
+
+func (m *invMsg) encode(e *encoder) {
+	e.putBytes([]byte(m.AddrFrom))
+	e.putBytes([]byte(m.Type))
+	e.putUint32(uint32(len(m.Items)))
+	for _, item := range m.Items {
+		e.putBytes(item)
+	}
+}
+
+func (m *invMsg) decode(d *decoder) {
+	m.AddrFrom = string(d.bytes())
+	m.Type = string(d.bytes())
+	if n := d.count(4); n > 0 {
+		m.Items = make([][]byte, n)
+		for i := range m.Items {
+			m.Items[i] = d.bytes()
+		}
+	}
+}
+
+func (m *getBlocksMsg) encode(e *encoder) {
+	e.putBytes([]byte(m.AddrFrom))
+}
+
+func (m *getBlocksMsg) decode(d *decoder) {
+	m.AddrFrom = string(d.bytes())
+}
+
+func (m *getDataMsg) encode(e *encoder) {
+	e.putBytes([]byte(m.AddrFrom))
+	e.putBytes([]byte(m.Type))
+	e.putBytes(m.ID)
+}
+
+func (m *getDataMsg) decode(d *decoder) {
+	m.AddrFrom = string(d.bytes())
+	m.Type = string(d.bytes())
+	m.ID = d.bytes()
+}
+
+func (m *blockMsg) encode(e *encoder) {
+	e.putBytes([]byte(m.AddrFrom))
+	e.putBytes(m.Block)
+}
+
+func (m *blockMsg) decode(d *decoder) {
+	m.AddrFrom = string(d.bytes())
+	m.Block = d.bytes()
+}
+
+func (m *txMsg) encode(e *encoder) {
+	e.putBytes([]byte(m.AddrFrom))
+	e.putBytes(m.Transaction)
+}
+
+func (m *txMsg) decode(d *decoder) {
+	m.AddrFrom = string(d.bytes())
+	m.Transaction = d.bytes()
+}
+
+type outgoingMsg struct {
+	addr    string
+	command string
+	payload message
+}
+
+// Node is a peer of the network. Every message is sent over its own TCP
+// connection and consists of a fixed-size command followed by the payload.
+type Node struct {
+	address string
+	miner   string
+	bc      *Blockchain
+	mempool *Mempool
+	log     *logrus.Logger
+
+	mu              sync.Mutex
+	peers           map[string]bool
+	blocksInTransit [][]byte
+	// syncing holds the peers asked for their whole chain, whose blocks have
+	// to connect to ours from then on
+	syncing map[string]bool
+	mining  bool
+	// cancelMining aborts the block being mined once a competing block arrives
+	cancelMining context.CancelFunc
+	// outbox queues the messages of the handlers, they are sent once mu is
+	// released so that slow peers don't hold the node up
+	outbox []outgoingMsg
+}
+
+func NewNode(log *logrus.Logger, bc *Blockchain, address, miner string, seeds []string) *Node {
+	node := Node{
+		address: address,
+		miner:   miner,
+		bc:      bc,
+		mempool: NewMempool(bc),
+		log:     log,
+		peers:   make(map[string]bool),
+		syncing: make(map[string]bool),
+	}
+	for _, seed := range seeds {
+		if seed != "" && seed != address {
+			node.peers[seed] = true
+		}
+	}
+	return &node
+}
+
+func (n *Node) Start() error {
+	ln, err := net.Listen(protocol, n.address)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := ln.Close(); err != nil {
+			n.log.Warnf("err closing listener: %s", err)
+		}
+	}()
+	n.log.Infof("node is listening on %s", n.address)
+
+	n.mu.Lock()
+	for peer := range n.peers {
+		if err = n.sendVersion(peer); err != nil {
+			n.log.Warnf("err sending version to %s: %s", peer, err)
+		}
+	}
+	n.flush()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go n.handleConnection(conn)
+	}
+}
+
+func (n *Node) handleConnection(conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			n.log.Warnf("err closing connection: %s", err)
+		}
+	}()
+	if err := conn.SetDeadline(time.Now().Add(messageTimeout)); err != nil {
+		n.log.Warnf("err setting deadline: %s", err)
+		return
+	}
+	request, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	if err != nil {
+		n.log.Warnf("err reading request: %s", err)
+		return
+	}
+	if len(request) > maxMessageSize {
+		n.log.Warnf("%s from %s", ErrMessageTooLarge, conn.RemoteAddr())
+		return
+	}
+	if len(request) < commandLength {
+		n.log.Warnf("err short message from %s", conn.RemoteAddr())
+		return
+	}
+	command := bytesToCommand(request[:commandLength])
+	payload := request[commandLength:]
+	n.log.Debugf("received %s command", command)
+
+	n.mu.Lock()
+	defer n.flush()
+	switch command {
+	case "version":
+		err = n.handleVersion(payload)
+	case "inv":
+		err = n.handleInv(payload)
+	case "getblocks":
+		err = n.handleGetBlocks(payload)
+	case "getdata":
+		err = n.handleGetData(payload)
+	case "block":
+		err = n.handleBlock(payload)
+	case "tx":
+		err = n.handleTx(payload)
+	default:
+		err = fmt.Errorf("%w %s", ErrUnknownCommand, command)
+	}
+	if err != nil {
+		n.log.Warnf("err handling %s: %s", command, err)
+	}
+}
+
+func (n *Node) handleVersion(payload []byte) error {
+	var msg versionMsg
+	if err := decodePayload(payload, &msg); err != nil {
+		return err
+	}
+	if msg.Magic != netParams.Magic {
+		delete(n.peers, msg.AddrFrom)
+		return fmt.Errorf("%w: %s has magic %08x", ErrNetworkMismatch, msg.AddrFrom, msg.Magic)
+	}
+	if msg.Version != nodeVersion {
+		return fmt.Errorf("peer %s speaks unsupported version %d", msg.AddrFrom, msg.Version)
+	}
+	genesis, err := n.bc.BlockByHeight(0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(msg.Genesis, genesis.Hash) {
+		delete(n.peers, msg.AddrFrom)
+		return fmt.Errorf("%w: %s has genesis %x", ErrChainMismatch, msg.AddrFrom, msg.Genesis)
+	}
+	myHeight, err := n.bc.Height()
+	if err != nil {
+		return err
+	}
+	known := n.peers[msg.AddrFrom]
+	n.peers[msg.AddrFrom] = true
+
+	if myHeight < msg.BestHeight {
+		if !n.syncing[msg.AddrFrom] {
+			return n.requestBlocks(msg.AddrFrom)
+		}
+		return nil
+	}
+	if myHeight > msg.BestHeight || !known {
+		return n.sendVersion(msg.AddrFrom)
+	}
+	return nil
+}
+
+func (n *Node) handleGetBlocks(payload []byte) error {
+	var msg getBlocksMsg
+	if err := decodePayload(payload, &msg); err != nil {
+		return err
+	}
+	hashes, err := n.bc.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	n.send(msg.AddrFrom, "inv", &invMsg{AddrFrom: n.address, Type: invTypeBlock, Items: hashes})
+	return nil
+}
+
+func (n *Node) handleInv(payload []byte) error {
+	var msg invMsg
+	if err := decodePayload(payload, &msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case invTypeBlock:
+		var missing [][]byte
+		for _, hash := range msg.Items {
+			exists, err := n.bc.HasBlock(hash)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				missing = append(missing, hash)
+			}
+		}
+		// peers announce hashes starting from the tip, so request them in reverse
+		// order to be able to connect every block as soon as it arrives
+		n.blocksInTransit = ReverseHashes(missing)
+		n.requestNextBlock(msg.AddrFrom)
+	case invTypeTx:
+		for _, txID := range msg.Items {
+			if _, ok := n.mempool.Get(txID); ok {
+				continue
+			}
+			n.send(msg.AddrFrom, "getdata", &getDataMsg{AddrFrom: n.address, Type: invTypeTx, ID: txID})
+		}
+	}
+	return nil
+}
+
+// requestBlocks asks the peer for its whole chain to connect an orphan block.
+// If a block of the peer is still an orphan afterwards, its chain doesn't
+// connect to ours and the peer is dropped instead of asked again.
+func (n *Node) requestBlocks(peer string) error {
+	if n.syncing[peer] {
+		delete(n.syncing, peer)
+		delete(n.peers, peer)
+		return fmt.Errorf("%w: blocks of %s don't connect", ErrChainMismatch, peer)
+	}
+	n.syncing[peer] = true
+	n.send(peer, "getblocks", &getBlocksMsg{AddrFrom: n.address})
+	return nil
+}
+
+func (n *Node) requestNextBlock(peer string) {
+	if len(n.blocksInTransit) == 0 {
+		return
+	}
+	hash := n.blocksInTransit[0]
+	n.blocksInTransit = n.blocksInTransit[1:]
+	n.send(peer, "getdata", &getDataMsg{AddrFrom: n.address, Type: invTypeBlock, ID: hash})
+}
+
+func (n *Node) handleGetData(payload []byte) error {
+	var msg getDataMsg
+	if err := decodePayload(payload, &msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case invTypeBlock:
+		block, err := n.bc.GetBlock(msg.ID)
+		if err != nil {
+			return err
+		}
+		serialized, err := block.Serialize()
+		if err != nil {
+			return err
+		}
+		n.send(msg.AddrFrom, "block", &blockMsg{AddrFrom: n.address, Block: serialized})
+	case invTypeTx:
+		tx, ok := n.mempool.Get(msg.ID)
+		if !ok {
+			return ErrTransactionNotFound
+		}
+		return n.sendTx(msg.AddrFrom, tx)
+	}
+	return nil
+}
+
+func (n *Node) handleBlock(payload []byte) error {
+	var msg blockMsg
+	if err := decodePayload(payload, &msg); err != nil {
+		return err
+	}
+	block, err := Deserialize(msg.Block)
+	if err != nil {
+		return err
+	}
+	if err = n.mempool.AddBlock(block); err != nil {
+		n.blocksInTransit = nil
+		if err == ErrOrphanBlock {
+			return n.requestBlocks(msg.AddrFrom)
+		}
+		return err
+	}
+	n.log.Infof("added block %x", block.Hash)
+	delete(n.syncing, msg.AddrFrom)
+	if n.cancelMining != nil {
+		n.cancelMining()
+	}
+
+	if len(n.blocksInTransit) > 0 {
+		n.requestNextBlock(msg.AddrFrom)
+		return nil
+	}
+	n.broadcast(msg.AddrFrom, invMsg{AddrFrom: n.address, Type: invTypeBlock, Items: [][]byte{block.Hash}})
+	return nil
+}
+
+func (n *Node) handleTx(payload []byte) error {
+	var msg txMsg
+	if err := decodePayload(payload, &msg); err != nil {
+		return err
+	}
+	tx, err := DeserializeTransaction(msg.Transaction)
+	if err != nil {
+		return err
+	}
+	if err = n.mempool.Add(tx); err != nil {
+		if err == ErrAlreadyInMempool {
+			return nil
+		}
+		return err
+	}
+	n.log.Infof("added transaction %x to mempool", tx.ID)
+	n.broadcast(msg.AddrFrom, invMsg{AddrFrom: n.address, Type: invTypeTx, Items: [][]byte{tx.ID}})
+
+	if n.miner != "" && !n.mining && n.mempool.Len() >= minerTxThreshold {
+		n.mining = true
+		go n.mine()
+	}
+	return nil
+}
+
+func (n *Node) mine() {
+	defer func() {
+		n.mu.Lock()
+		n.mining = false
+		n.cancelMining = nil
+		n.mu.Unlock()
+	}()
+	for n.mempool.Len() >= minerTxThreshold {
+		ctx, cancel := context.WithCancel(context.Background())
+		n.mu.Lock()
+		n.cancelMining = cancel
+		n.mu.Unlock()
+		block, err := n.mempool.AssembleBlock(ctx, n.miner, maxBlockTransactions)
+		cancel()
+		if err == context.Canceled {
+			n.log.Infof("mining aborted, a new block arrived")
+			continue
+		}
+		if err != nil {
+			n.log.Warnf("err mining block: %s", err)
+			// drop the transactions which made the block invalid and retry
+			// with the rest, unless the error wasn't caused by any of them
+			if n.mempool.EvictInvalid() == 0 {
+				return
+			}
+			continue
+		}
+		n.log.Infof("mined block %x", block.Hash)
+
+		n.mu.Lock()
+		n.broadcast("", invMsg{AddrFrom: n.address, Type: invTypeBlock, Items: [][]byte{block.Hash}})
+		n.flush()
+	}
+}
+
+func (n *Node) sendVersion(addr string) error {
+	bestHeight, err := n.bc.Height()
+	if err != nil {
+		return err
+	}
+	genesis, err := n.bc.BlockByHeight(0)
+	if err != nil {
+		return err
+	}
+	n.send(addr, "version", &versionMsg{Magic: netParams.Magic, Version: nodeVersion, BestHeight: bestHeight, Genesis: genesis.Hash, AddrFrom: n.address})
+	return nil
+}
+
+func (n *Node) sendTx(addr string, tx *Transaction) error {
+	serialized, err := tx.Serialize()
+	if err != nil {
+		return err
+	}
+	n.send(addr, "tx", &txMsg{AddrFrom: n.address, Transaction: serialized})
+	return nil
+}
+
+// broadcast sends the message to every known peer except the one it came from.
+func (n *Node) broadcast(except string, msg invMsg) {
+	for peer := range n.peers {
+		if peer == except {
+			continue
+		}
+		n.send(peer, "inv", &msg)
+	}
+}
+
+// send queues the message, n.mu has to be held.
+func (n *Node) send(addr, command string, payload message) {
+	n.outbox = append(n.outbox, outgoingMsg{addr: addr, command: command, payload: payload})
+}
+
+// flush releases n.mu and sends the queued messages, forgetting the peers
+// which can't be reached.
+func (n *Node) flush() {
+	msgs := n.outbox
+	n.outbox = nil
+	n.mu.Unlock()
+	for _, msg := range msgs {
+		if err := SendMessage(msg.addr, msg.command, msg.payload); err != nil {
+			n.log.Warnf("err sending %s to %s: %s", msg.command, msg.addr, err)
+			n.mu.Lock()
+			delete(n.peers, msg.addr)
+			n.mu.Unlock()
+		}
+	}
+}
+
+// SubmitTransaction relays a transaction to the node listening on addr.
+func SubmitTransaction(addr string, tx *Transaction) error {
+	serialized, err := tx.Serialize()
+	if err != nil {
+		return err
+	}
+	return SendMessage(addr, "tx", &txMsg{AddrFrom: "", Transaction: serialized})
+}
+
+func SendMessage(addr, command string, payload message) error {
+	encoded := encodePayload(payload)
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(messageTimeout)); err != nil {
+		return err
+	}
+	_, err = io.Copy(conn, bytes.NewReader(append(commandToBytes(command), encoded...)))
+	return err
+}
+
+func encodePayload(payload message) []byte {
+	var e encoder
+	e.putByte(messageEncodingVersion)
+	payload.encode(&e)
+	return e.buf
+}
+
+func decodePayload(payload []byte, msg message) error {
+	d := decoder{data: payload}
+	d.version(messageEncodingVersion)
+	msg.decode(&d)
+	return d.finish()
+}
+
+func commandToBytes(command string) []byte {
+	var result [commandLength]byte
+	copy(result[:], command)
+	return result[:]
+}
+
+func bytesToCommand(data []byte) string {
+	return string(bytes.TrimRight(data, "\x00"))
+}
@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeDropsPeersOnOtherChains(t *testing.T) {
+	bc, _, address := newTestChain(t)
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	node := NewNode(log, bc, "localhost:0", "", nil)
+	genesis, err := bc.BlockByHeight(0)
+	require.NoError(t, err)
+
+	handle := func(handler func([]byte) error, msg message) ([]outgoingMsg, error) {
+		payload := encodePayload(msg)
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		err := handler(payload)
+		sent := node.outbox
+		node.outbox = nil
+		return sent, err
+	}
+
+	node.peers["testnet"] = true
+	_, err = handle(node.handleVersion, &versionMsg{Magic: TestNetParams.Magic, Version: nodeVersion, BestHeight: 5, Genesis: genesis.Hash, AddrFrom: "testnet"})
+	require.ErrorIs(t, err, ErrNetworkMismatch)
+	require.False(t, node.peers["testnet"])
+
+	_, err = handle(node.handleVersion, &versionMsg{Magic: netParams.Magic, Version: nodeVersion, BestHeight: 5, Genesis: []byte{1}, AddrFrom: "other"})
+	require.ErrorIs(t, err, ErrChainMismatch)
+	require.False(t, node.peers["other"])
+
+	sent, err := handle(node.handleVersion, &versionMsg{Magic: netParams.Magic, Version: nodeVersion, BestHeight: 5, Genesis: genesis.Hash, AddrFrom: "peer"})
+	require.NoError(t, err)
+	require.True(t, node.peers["peer"])
+	require.Len(t, sent, 1)
+	require.Equal(t, "getblocks", sent[0].command)
+
+	block := mineOn(t, bc, genesis, address)
+	cbTx, err := CreateCoinbaseTX(address, "", 0)
+	require.NoError(t, err)
+	orphan := NewBlock([]*Transaction{cbTx}, make([]byte, 32), 2)
+	orphan.Bits = block.Bits
+	require.NoError(t, bc.consensus.Seal(context.Background(), orphan))
+	deliver := func(block *Block) ([]outgoingMsg, error) {
+		serialized, err := block.Serialize()
+		require.NoError(t, err)
+		return handle(node.handleBlock, &blockMsg{AddrFrom: "peer", Block: serialized})
+	}
+
+	// an orphan after the peer was asked for its chain means the chains
+	// don't connect
+	_, err = deliver(orphan)
+	require.ErrorIs(t, err, ErrChainMismatch)
+	require.False(t, node.peers["peer"])
+
+	// a block connecting to ours ends the sync, later orphans ask again
+	node.peers["peer"] = true
+	_, err = deliver(block)
+	require.NoError(t, err)
+	sent, err = deliver(orphan)
+	require.NoError(t, err)
+	require.Len(t, sent, 1)
+	require.Equal(t, "getblocks", sent[0].command)
+	require.True(t, node.peers["peer"])
+}
+
+func TestMessageEncoding(t *testing.T) {
+	msgs := []struct {
+		msg     message
+		decoded message
+	}{
+		{&versionMsg{Magic: netParams.Magic, Version: nodeVersion, BestHeight: 7, Genesis: []byte{1, 2}, AddrFrom: "localhost:3000"}, &versionMsg{}},
+		{&invMsg{AddrFrom: "a", Type: invTypeBlock, Items: [][]byte{{1}, {2, 3}}}, &invMsg{}},
+		{&getBlocksMsg{AddrFrom: "a"}, &getBlocksMsg{}},
+		{&getDataMsg{AddrFrom: "a", Type: invTypeTx, ID: []byte{4}}, &getDataMsg{}},
+		{&blockMsg{AddrFrom: "a", Block: []byte{5, 6}}, &blockMsg{}},
+		{&txMsg{Transaction: []byte{7}}, &txMsg{}},
+	}
+	for _, m := range msgs {
+		encoded := encodePayload(m.msg)
+		require.NoError(t, decodePayload(encoded, m.decoded))
+		require.Equal(t, m.msg, m.decoded)
+		require.ErrorIs(t, decodePayload(encoded[:len(encoded)-1], m.decoded), ErrMalformedData)
+		require.ErrorIs(t, decodePayload(append(encoded, 0), m.decoded), ErrMalformedData)
+	}
+	require.ErrorIs(t, decodePayload([]byte{0xff}, &getBlocksMsg{}), ErrUnknownVersion)
+	// a huge item count can't allocate more than the payload holds
+	require.ErrorIs(t, decodePayload([]byte{messageEncodingVersion, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, &invMsg{}), ErrMalformedData)
+}
@@ -3,48 +3,74 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/big"
 )
 
-const subsidy = 10
-
 var ErrInsufficientFunds = errors.New("err not enough money")
 var ErrIncorrectTransaction = errors.New("err incorrect transaction")
 var ErrTransactionNotFound = errors.New("err transaction not found")
+var ErrInsufficientFee = errors.New("err inputs don't cover outputs and fee")
+var ErrCoinbaseOverpay = errors.New("err coinbase pays more than subsidy and fees")
+var ErrDuplicateRecipient = errors.New("err address appears more than once among recipients")
+var ErrAmountOverflow = errors.New("err total amount overflows")
+var ErrTransactionNotFinal = errors.New("err transaction can't be mined before its lock time")
+
+const maxInt = int(^uint(0) >> 1)
 
+// Transaction moves the value of the outputs its inputs spend to its own
+// outputs. It can't be mined below the LockTime height.
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput
-	Vout []TXOutput
+	ID       []byte
+	Vin      []TXInput
+	Vout     []TXOutput
+	LockTime int
 }
 
+// TXInput spends an output, the unlocking script pushing what the output's
+// locking script requires. Coinbase inputs hold arbitrary data in its place.
 type TXInput struct {
-	Txid      []byte
-	Vout      int
-	Signature []byte
-	PubKey    []byte
+	Txid            []byte
+	Vout            int
+	UnlockingScript []byte
 }
 
 type TXOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value         int
+	LockingScript []byte
+}
+
+// Recipient is an address paid by a transaction being built.
+type Recipient struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
 }
 
-func CreateCoinbaseTX(to, data string) (*Transaction, error) {
+func CreateCoinbaseTX(to, data string, fees int) (*Transaction, error) {
+	if fees < 0 {
+		return nil, ErrIncorrectTransaction
+	}
 	if data == "" {
-		data = fmt.Sprintf("Reward to '%s'", to)
+		randData := make([]byte, 20)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf("Reward to '%s' %x", to, randData)
 	}
-	var err error
 
-	txin := TXInput{Txid: []byte{}, Vout: -1, PubKey: []byte(data)}
-	txout := NewTXOutput(subsidy, to)
+	reward, err := addValue(netParams.Subsidy, fees)
+	if err != nil {
+		return nil, err
+	}
+
+	txin := TXInput{Txid: []byte{}, Vout: -1, UnlockingScript: []byte(data)}
+	txout, err := NewTXOutput(reward, to)
+	if err != nil {
+		return nil, err
+	}
 	tx := Transaction{ID: nil, Vin: []TXInput{txin}, Vout: []TXOutput{*txout}}
 	if tx.ID, err = tx.Hash(); err != nil {
 		return nil, err
@@ -52,175 +78,349 @@ func CreateCoinbaseTX(to, data string) (*Transaction, error) {
 	return &tx, nil
 }
 
-func CreateUTXOTransaction(from, to string, amount int, bc *Blockchain) (*Transaction, error) {
-	var inputs []TXInput
-	var outputs []TXOutput
+func CreateUTXOTransaction(wallet *Wallet, to string, amount, fee int, selector CoinSelector, bc *Blockchain) (*Transaction, error) {
+	return CreateSendManyTransaction(wallet, []Recipient{{Address: to, Amount: amount}}, fee, selector, bc)
+}
 
-	wallets, err := GetWallets()
+// CreateSendManyTransaction builds a single transaction paying every recipient,
+// the change going back to the wallet's address in one more output. The inputs
+// are picked by the selector, nil meaning the default branch and bound.
+func CreateSendManyTransaction(wallet *Wallet, recipients []Recipient, fee int, selector CoinSelector, bc *Blockchain) (*Transaction, error) {
+	from, err := wallet.GetAddress()
 	if err != nil {
 		return nil, err
 	}
-	wallet, err := wallets.GetWallet(from)
+	pubKeyHash, err := HashPubKey(wallet.PublicKey)
 	if err != nil {
 		return nil, err
 	}
-	pubKeyHash, err := HashPubKey(wallet.PublicKey)
+	tx, err := createTransaction(pubKeyHash, nil, string(from), recipients, fee, selector, bc)
 	if err != nil {
 		return nil, err
 	}
-	acc, validOutputs, err := bc.FindSpendableOutputs(pubKeyHash, amount)
+	if err = bc.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// createTransaction builds an unsigned transaction spending outputs locked to
+// the hash, its inputs starting with the unlocking script.
+func createTransaction(lockingHash, unlocking []byte, change string, recipients []Recipient, fee int, selector CoinSelector, bc *Blockchain) (*Transaction, error) {
+	var inputs []TXInput
+	var outputs []TXOutput
+
+	amount, err := recipientsTotal(recipients)
 	if err != nil {
 		return nil, err
 	}
-	if acc < amount {
-		return nil, ErrInsufficientFunds
+	if fee < 0 {
+		return nil, ErrIncorrectTransaction
+	}
+	if amount > maxInt-fee {
+		return nil, ErrAmountOverflow
+	}
+	if selector == nil {
+		selector = NewBranchAndBound()
+	}
+	spendable, err := bc.SpendableOutputs(lockingHash)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selector.Select(spendable, amount+fee)
+	if err != nil {
+		return nil, err
 	}
 
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
+	acc := 0
+	for _, out := range selected {
+		inputs = append(inputs, TXInput{Txid: out.Txid, Vout: out.Vout, UnlockingScript: unlocking})
+		acc += out.Value
+	}
+	if acc < amount+fee {
+		return nil, ErrInsufficientFunds
+	}
+	for _, recipient := range recipients {
+		out, err := NewTXOutput(recipient.Amount, recipient.Address)
 		if err != nil {
 			return nil, err
 		}
-		for _, out := range outs {
-			inputs = append(inputs, TXInput{Txid: txID, Vout: out, PubKey: wallet.PublicKey})
-		}
+		outputs = append(outputs, *out)
 	}
-	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > amount+fee {
+		out, err := NewTXOutput(acc-amount-fee, change)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *out)
 	}
 
 	tx := Transaction{ID: nil, Vin: inputs, Vout: outputs}
 	if tx.ID, err = tx.Hash(); err != nil {
 		return nil, err
 	}
-	if err = bc.SignTransaction(&tx, wallet.PrivateKey); err != nil {
-		return nil, err
-	}
 	return &tx, nil
 }
 
+// recipientsTotal validates the recipients and sums their amounts.
+func recipientsTotal(recipients []Recipient) (int, error) {
+	if len(recipients) == 0 {
+		return 0, ErrIncorrectTransaction
+	}
+	total := 0
+	seen := make(map[string]bool)
+	for _, recipient := range recipients {
+		pubKeyHash, err := lockingHashFromAddress(recipient.Address)
+		if err != nil {
+			return 0, err
+		}
+		if seen[string(pubKeyHash)] {
+			return 0, ErrDuplicateRecipient
+		}
+		seen[string(pubKeyHash)] = true
+		if recipient.Amount <= 0 {
+			return 0, ErrIncorrectTransaction
+		}
+		if total > maxInt-recipient.Amount {
+			return 0, ErrAmountOverflow
+		}
+		total += recipient.Amount
+	}
+	return total, nil
+}
+
+// checkTransactionID makes sure the ID is the hash of the transaction's content.
+func checkTransactionID(tx *Transaction) error {
+	hash, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, tx.ID) {
+		return ErrIncorrectTransaction
+	}
+	return nil
+}
+
+// OutputsValue sums the values of the outputs, failing if any of them is
+// negative or the sum overflows.
+func (tx Transaction) OutputsValue() (int, error) {
+	value := 0
+	for _, out := range tx.Vout {
+		var err error
+		if value, err = addValue(value, out.Value); err != nil {
+			return 0, err
+		}
+	}
+	return value, nil
+}
+
+// addValue adds a non negative amount to the total checking for overflow.
+func addValue(total, value int) (int, error) {
+	if value < 0 {
+		return 0, ErrIncorrectTransaction
+	}
+	if total > maxInt-value {
+		return 0, ErrAmountOverflow
+	}
+	return total + value, nil
+}
+
+// isFinal tells whether the transaction can be mined at the height.
+func (tx Transaction) isFinal(height int) bool {
+	return tx.LockTime <= height
+}
+
 func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
+func (in TXInput) outpoint() string {
+	return fmt.Sprintf("%x:%d", in.Txid, in.Vout)
+}
+
+// UsesKey tells whether the input spends a pay to public key hash output with
+// the key of the hash.
 func (in *TXInput) UsesKey(pubKeyHash []byte) (bool, error) {
-	lockingHash, err := HashPubKey(in.PubKey)
+	_, pubKey, err := parseUnlockingScript(in.UnlockingScript)
+	if err != nil {
+		return false, nil
+	}
+	lockingHash, err := HashPubKey(pubKey)
 	if err != nil {
 		return false, err
 	}
 	return bytes.Equal(lockingHash, pubKeyHash), nil
 }
 
-func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+// Lock sets the standard locking script paying to the address, pay to script
+// hash for multisig addresses and pay to public key hash otherwise. Addresses
+// of other networks are rejected.
+func (out *TXOutput) Lock(address []byte) error {
+	hash, err := lockingHashFromAddress(string(address))
+	if err != nil {
+		return err
+	}
+	if version, _, _ := decodeAddress(string(address)); version == netParams.MultisigVersion {
+		out.LockingScript = PayToScriptHashScript(hash)
+		return nil
+	}
+	out.LockingScript = PayToPubKeyHashScript(hash)
+	return nil
+}
+
+// lockingHash returns the key or script hash of a standard locking script, nil
+// for other scripts.
+func (out *TXOutput) lockingHash() []byte {
+	if hash := payToPubKeyHash(out.LockingScript); hash != nil {
+		return hash
+	}
+	return payToScriptHash(out.LockingScript)
 }
 
 func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Equal(out.PubKeyHash, pubKeyHash)
+	hash := out.lockingHash()
+	return hash != nil && bytes.Equal(hash, pubKeyHash)
 }
 
-func NewTXOutput(value int, address string) *TXOutput {
+func NewTXOutput(value int, address string) (*TXOutput, error) {
 	txo := TXOutput{value, nil}
-	txo.Lock([]byte(address))
-	return &txo
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
+	return &txo, nil
 }
 
+// Sing signs the inputs with the private key. Inputs spending pay to script
+// hash outputs have to carry the multisig script already, the signature is
+// added to the ones of the other cosigners.
 func (tx *Transaction) Sing(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	if tx.IsCoinbase() {
 		return nil
 	}
-	var err error
 	for _, vin := range tx.Vin {
-		if val, ok := prevTXs[hex.EncodeToString(vin.Txid)]; !ok || val.ID == nil {
+		if val, ok := prevTXs[hex.EncodeToString(vin.Txid)]; !ok || val.ID == nil || vin.Vout < 0 || vin.Vout >= len(val.Vout) {
 			return ErrIncorrectTransaction
 		}
 	}
-	txCopy := tx.TrimmedCopy()
-	for inID, vin := range txCopy.Vin {
+	for inID, vin := range tx.Vin {
 		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		if txCopy.ID, err = txCopy.Hash(); err != nil {
+		hash, err := tx.signatureHash(inID, prevTx)
+		if err != nil {
 			return err
 		}
-		txCopy.Vin[inID].PubKey = nil
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
+		if payToScriptHash(prevTx.Vout[vin.Vout].LockingScript) != nil {
+			if tx.Vin[inID].UnlockingScript, err = signMultisigInput(vin.UnlockingScript, &privKey, hash); err != nil {
+				return err
+			}
+			continue
+		}
+		signature, err := signHash(&privKey, hash)
 		if err != nil {
 			return err
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Vin[inID].Signature = signature
+		tx.Vin[inID].UnlockingScript = unlockingScript(signature, publicKeyBytes(&privKey.PublicKey))
 	}
 	return nil
 }
 
+// signatureHash is the hash the input's signatures sign: the hash of the
+// transaction without unlocking scripts, the spent output's locking script
+// standing in for the input's one.
+func (tx *Transaction) signatureHash(inID int, prevTx Transaction) ([]byte, error) {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].UnlockingScript = prevTx.Vout[tx.Vin[inID].Vout].LockingScript
+	return txCopy.Hash()
+}
+
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil})
 	}
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.LockingScript})
 	}
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 	return txCopy
 }
 
+// Hash returns the hash of the transaction's encoding, which doesn't include
+// its ID.
 func (tx *Transaction) Hash() ([]byte, error) {
-	var hash [32]byte
-	txCopy := *tx
-	txCopy.ID = []byte{}
-	serialized, err := txCopy.Serialize()
+	serialized, err := tx.Serialize()
 	if err != nil {
 		return nil, err
 	}
-	hash = sha256.Sum256(serialized)
+	hash := sha256.Sum256(serialized)
 	return hash[:], nil
 }
 
 func (tx *Transaction) Serialize() ([]byte, error) {
-	var encoded bytes.Buffer
-	if err := gob.NewEncoder(&encoded).Encode(tx); err != nil {
+	var e encoder
+	encodeTransaction(&e, tx)
+	return e.buf, nil
+}
+
+// DeserializeTransaction decodes the transaction setting its ID to the hash of
+// the data.
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	d := decoder{data: data}
+	tx := decodeTransaction(&d)
+	if err := d.finish(); err != nil {
 		return nil, err
 	}
-	return encoded.Bytes(), nil
+	var err error
+	if tx.ID, err = tx.Hash(); err != nil {
+		return nil, err
+	}
+	return tx, nil
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) (bool, error) {
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-	var err error
+func (in *TXInput) Serialize() ([]byte, error) {
+	var e encoder
+	encodeInput(&e, in)
+	return e.buf, nil
+}
+
+func DeserializeTXInput(data []byte) (*TXInput, error) {
+	d := decoder{data: data}
+	in := decodeInput(&d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+func (out *TXOutput) Serialize() ([]byte, error) {
+	var e encoder
+	encodeOutput(&e, out)
+	return e.buf, nil
+}
 
+func DeserializeTXOutput(data []byte) (*TXOutput, error) {
+	d := decoder{data: data}
+	out := decodeOutput(&d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Verify runs the unlocking script of every input followed by the locking
+// script of the output it spends.
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) (bool, error) {
 	for inID, vin := range tx.Vin {
 		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
-		if !ok {
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
 			return false, nil
 		}
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		if txCopy.ID, err = txCopy.Hash(); err != nil {
+		hash, err := tx.signatureHash(inID, prevTx)
+		if err != nil {
 			return false, err
 		}
-		txCopy.Vin[inID].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if !ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) {
+		if err = verifyScripts(tx, vin.UnlockingScript, prevTx.Vout[vin.Vout].LockingScript, hash); err != nil {
 			return false, nil
 		}
 	}
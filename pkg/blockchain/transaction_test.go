@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAddress(t *testing.T) (*Wallet, string) {
+	wallet, err := CreateWallet()
+	require.NoError(t, err)
+	address, err := wallet.GetAddress()
+	require.NoError(t, err)
+	return wallet, string(address)
+}
+
+func newTestOutput(t *testing.T, value int, address string) TXOutput {
+	out, err := NewTXOutput(value, address)
+	require.NoError(t, err)
+	return *out
+}
+
+func TestRecipientsTotal(t *testing.T) {
+	_, a := newTestAddress(t)
+	_, b := newTestAddress(t)
+
+	total, err := recipientsTotal([]Recipient{{a, 3}, {b, 4}})
+	require.NoError(t, err)
+	require.Equal(t, 7, total)
+
+	_, err = recipientsTotal([]Recipient{{a, 3}, {b, 4}, {a, 1}})
+	require.ErrorIs(t, err, ErrDuplicateRecipient)
+	_, err = recipientsTotal([]Recipient{{a, maxInt}, {b, 1}})
+	require.ErrorIs(t, err, ErrAmountOverflow)
+	_, err = recipientsTotal([]Recipient{{a, 0}})
+	require.ErrorIs(t, err, ErrIncorrectTransaction)
+	_, err = recipientsTotal([]Recipient{{"nosuchaddress", 1}})
+	require.ErrorIs(t, err, ErrInvalidAddress)
+	_, err = recipientsTotal(nil)
+	require.ErrorIs(t, err, ErrIncorrectTransaction)
+}
+
+func TestSendMany(t *testing.T) {
+	SetDataDir(t.TempDir())
+	SetNetwork(&RegTestParams)
+	defer SetNetwork(&MainNetParams)
+
+	wallet, from := newTestAddress(t)
+	_, a := newTestAddress(t)
+	_, b := newTestAddress(t)
+	_, err := CreateBlockchain(from)
+	require.NoError(t, err)
+	bc, err := GetBlockchain()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, bc.db.Close())
+	}()
+	_, err = bc.Generate(context.Background(), 2, from)
+	require.NoError(t, err)
+
+	tx, err := CreateSendManyTransaction(wallet, []Recipient{{a, 5}, {b, 12}}, 1, nil, bc)
+	require.NoError(t, err)
+	require.Len(t, tx.Vout, 3)
+	require.Len(t, tx.Vin, 2)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{tx})
+	require.NoError(t, err)
+
+	for address, expected := range map[string]int{a: 5, b: 12, from: 30 - 18} {
+		balance, err := bc.GetBalance(address)
+		require.NoError(t, err)
+		require.Equal(t, expected, balance)
+	}
+	_, err = CreateSendManyTransaction(wallet, []Recipient{{a, maxInt}}, 1, nil, bc)
+	require.ErrorIs(t, err, ErrAmountOverflow)
+}
+
+func TestNewTXOutput(t *testing.T) {
+	wallet, mainnet := newTestAddress(t)
+	script, err := NewMultisigScript(1, [][]byte{wallet.PublicKey})
+	require.NoError(t, err)
+	multisig, err := script.Address()
+	require.NoError(t, err)
+
+	out := newTestOutput(t, 1, mainnet)
+	require.NotNil(t, payToPubKeyHash(out.LockingScript))
+	out = newTestOutput(t, 1, string(multisig))
+	require.NotNil(t, payToScriptHash(out.LockingScript))
+
+	_, err = NewTXOutput(1, "nonsense")
+	require.ErrorIs(t, err, ErrInvalidAddress)
+	SetNetwork(&RegTestParams)
+	defer SetNetwork(&MainNetParams)
+	_, err = NewTXOutput(1, mainnet)
+	require.ErrorIs(t, err, ErrInvalidAddress)
+	_, err = NewTXOutput(1, string(multisig))
+	require.ErrorIs(t, err, ErrInvalidAddress)
+	_, err = CreateCoinbaseTX(mainnet, "", 0)
+	require.ErrorIs(t, err, ErrInvalidAddress)
+}
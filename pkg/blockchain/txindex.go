@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+)
+
+// txIndexBucket maps IDs of the main chain transactions to the hash of their
+// block and their position in it. The index is optional, it's maintained only
+// while the bucket exists. New chains are created with it, reindex
+// -txindex=false drops it.
+const txIndexBucket = "txindex"
+
+type txLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+func (l *txLocation) serialize() []byte {
+	var e encoder
+	e.putBytes(l.BlockHash)
+	e.putUint32(uint32(l.Position))
+	return e.buf
+}
+
+func deserializeTxLocation(data []byte) (*txLocation, error) {
+	d := decoder{data: data}
+	location := txLocation{BlockHash: d.bytes(), Position: int(d.uint32())}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &location, nil
+}
+
+func (bc *Blockchain) HasTxIndex() (bool, error) {
+	var enabled bool
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		enabled = tx.Bucket([]byte(txIndexBucket)) != nil
+		return nil
+	})
+	return enabled, err
+}
+
+// ReindexTransactions enables the transaction index and builds it from the
+// blocks of the main chain.
+func (bc *Blockchain) ReindexTransactions() error {
+	hashes, err := bc.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		if err := resetTxIndex(tx); err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			if err = indexTransactions(tx, block); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DropTxIndex disables the transaction index, FindTransaction goes back to
+// scanning the chain.
+func (bc *Blockchain) DropTxIndex() error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(txIndexBucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// resetTxIndex empties the transaction index, creating it if it's missing.
+func resetTxIndex(tx *bolt.Tx) error {
+	if err := tx.DeleteBucket([]byte(txIndexBucket)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	_, err := tx.CreateBucket([]byte(txIndexBucket))
+	return err
+}
+
+func indexTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+	for i, transaction := range block.Transactions {
+		location := txLocation{BlockHash: block.Hash, Position: i}
+		if err := b.Put(transaction.ID, location.serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unindexTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+	for _, transaction := range block.Transactions {
+		if err := b.Delete(transaction.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findIndexedTransaction looks the transaction up in the index. It returns
+// false if the index is disabled.
+func findIndexedTransaction(tx *bolt.Tx, ID []byte) (*Transaction, bool, error) {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil, false, nil
+	}
+	data := b.Get(ID)
+	if data == nil {
+		return nil, true, ErrTransactionNotFound
+	}
+	location, err := deserializeTxLocation(data)
+	if err != nil {
+		return nil, true, err
+	}
+	block, err := getBlock(tx, location.BlockHash)
+	if err != nil {
+		return nil, true, err
+	}
+	if location.Position >= len(block.Transactions) || !bytes.Equal(block.Transactions[location.Position].ID, ID) {
+		return nil, true, ErrTransactionNotFound
+	}
+	return block.Transactions[location.Position], true, nil
+}
@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+// indexedTransaction looks the transaction up in the index only.
+func indexedTransaction(t *testing.T, bc *Blockchain, ID []byte) (*Transaction, bool, error) {
+	var transaction *Transaction
+	var indexed bool
+	var findErr error
+	require.NoError(t, bc.db.View(func(tx *bolt.Tx) error {
+		transaction, indexed, findErr = findIndexedTransaction(tx, ID)
+		return nil
+	}))
+	return transaction, indexed, findErr
+}
+
+func TestTxIndex(t *testing.T) {
+	bc, wallet, from := newTestChain(t)
+	_, to := newTestAddress(t)
+	_, miner := newTestAddress(t)
+	mp := NewMempool(bc)
+	enabled, err := bc.HasTxIndex()
+	require.NoError(t, err)
+	require.True(t, enabled)
+
+	genesis, err := bc.GetBlock(bc.Tip())
+	require.NoError(t, err)
+	b1 := mineOn(t, bc, genesis, from)
+	require.NoError(t, mp.AddBlock(b1))
+	tx, err := CreateUTXOTransaction(wallet, to, 5, 0, nil, bc)
+	require.NoError(t, err)
+	m2 := mineOn(t, bc, b1, from, tx)
+	require.NoError(t, mp.AddBlock(m2))
+
+	found, indexed, err := indexedTransaction(t, bc, tx.ID)
+	require.NoError(t, err)
+	require.True(t, indexed)
+	require.Equal(t, tx.ID, found.ID)
+
+	// the index follows the main chain through reorganizations
+	s2 := mineOn(t, bc, b1, miner)
+	require.NoError(t, mp.AddBlock(s2))
+	s3 := mineOn(t, bc, s2, miner)
+	require.NoError(t, mp.AddBlock(s3))
+	_, indexed, err = indexedTransaction(t, bc, tx.ID)
+	require.True(t, indexed)
+	require.ErrorIs(t, err, ErrTransactionNotFound)
+	found, _, err = indexedTransaction(t, bc, s3.Transactions[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, s3.Transactions[0].ID, found.ID)
+
+	m3 := mineOn(t, bc, m2, from)
+	require.NoError(t, mp.AddBlock(m3))
+	m4 := mineOn(t, bc, m3, from)
+	require.NoError(t, mp.AddBlock(m4))
+	_, _, err = indexedTransaction(t, bc, tx.ID)
+	require.NoError(t, err)
+	_, _, err = indexedTransaction(t, bc, s3.Transactions[0].ID)
+	require.ErrorIs(t, err, ErrTransactionNotFound)
+
+	require.NoError(t, bc.DropTxIndex())
+	enabled, err = bc.HasTxIndex()
+	require.NoError(t, err)
+	require.False(t, enabled)
+	_, indexed, _ = indexedTransaction(t, bc, tx.ID)
+	require.False(t, indexed)
+	found, err = bc.FindTransaction(tx.ID)
+	require.NoError(t, err)
+	require.Equal(t, tx.ID, found.ID)
+	require.NoError(t, bc.ReindexUTXO())
+	enabled, err = bc.HasTxIndex()
+	require.NoError(t, err)
+	require.False(t, enabled)
+
+	require.NoError(t, bc.ReindexTransactions())
+	for _, block := range []*Block{genesis, b1, m2, m3, m4} {
+		for _, transaction := range block.Transactions {
+			found, indexed, err := indexedTransaction(t, bc, transaction.ID)
+			require.NoError(t, err)
+			require.True(t, indexed)
+			require.Equal(t, transaction.ID, found.ID)
+		}
+	}
+	_, _, err = indexedTransaction(t, bc, s2.Transactions[0].ID)
+	require.ErrorIs(t, err, ErrTransactionNotFound)
+}
@@ -1,11 +1,17 @@
 package blockchain
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/term"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func IntToHex(num int64) []byte {
@@ -23,7 +29,7 @@ func intToHex(i int64) []byte {
 }
 
 func dbExists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+	if _, err := os.Stat(dbPath()); os.IsNotExist(err) {
 		return false
 	}
 
@@ -36,3 +42,41 @@ func ReverseBytes(data []byte) []byte {
 	}
 	return data
 }
+
+func ReverseHashes(hashes [][]byte) [][]byte {
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	return hashes
+}
+
+// readPassphrase prompts for a passphrase on stderr, reading it without echo
+// when stdin is a terminal.
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		return string(passphrase), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readNewPassphrase() (string, error) {
+	passphrase, err := readPassphrase("Enter new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := readPassphrase("Repeat new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirmation {
+		return "", errors.New("err passphrases don't match")
+	}
+	return passphrase, nil
+}
@@ -15,3 +15,11 @@ func TestIntToHex(t *testing.T) {
 		require.NotEqual(t, a, b, "err on %dth iteration: n = %d", i, n)
 	}
 }
+
+func TestBase58LeadingZeros(t *testing.T) {
+	for _, input := range [][]byte{{0x6f, 0x01}, {0x00, 0x00, 0x01}, {0x00}} {
+		encoded := Base58Encode(input)
+		require.Equal(t, input, Base58Decode(encoded))
+	}
+	require.Equal(t, "115T", string(Base58Encode([]byte{0x00, 0x00, 0x01, 0x02})))
+}
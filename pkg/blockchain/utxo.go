@@ -0,0 +1,523 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/boltdb/bolt"
+	"sort"
+)
+
+const (
+	utxoBucket = "chainstate"
+	undoBucket = "undo"
+)
+
+var ErrOutputSpent = errors.New("err output is spent or doesn't exist")
+
+// TXOutputs holds the unspent outputs of a single transaction keyed by their
+// index in the transaction's Vout.
+type TXOutputs struct {
+	Outputs map[int]TXOutput
+}
+
+// utxoView is the UTXO set transactions are applied to, either the stored one
+// or an overlay keeping the changes in memory.
+type utxoView interface {
+	// getOutputs returns the unspent outputs of the transaction failing with
+	// ErrOutputSpent if there are none
+	getOutputs(txID []byte) (*TXOutputs, error)
+	putOutputs(txID []byte, outs *TXOutputs) error
+}
+
+type bucketView struct {
+	b *bolt.Bucket
+}
+
+func (v bucketView) getOutputs(txID []byte) (*TXOutputs, error) {
+	return getOutputs(v.b, txID)
+}
+
+func (v bucketView) putOutputs(txID []byte, outs *TXOutputs) error {
+	return putOutputs(v.b, txID, outs)
+}
+
+// overlayView applies changes on top of a read-only view without writing them,
+// which allows validating transactions within a read-only db transaction.
+type overlayView struct {
+	base    utxoView
+	changes map[string]*TXOutputs
+}
+
+func newOverlayView(base utxoView) *overlayView {
+	return &overlayView{base: base, changes: make(map[string]*TXOutputs)}
+}
+
+func (v *overlayView) getOutputs(txID []byte) (*TXOutputs, error) {
+	outs, ok := v.changes[hex.EncodeToString(txID)]
+	if !ok {
+		return v.base.getOutputs(txID)
+	}
+	if len(outs.Outputs) == 0 {
+		return nil, ErrOutputSpent
+	}
+	copied := TXOutputs{Outputs: make(map[int]TXOutput, len(outs.Outputs))}
+	for idx, out := range outs.Outputs {
+		copied.Outputs[idx] = out
+	}
+	return &copied, nil
+}
+
+func (v *overlayView) putOutputs(txID []byte, outs *TXOutputs) error {
+	v.changes[hex.EncodeToString(txID)] = outs
+	return nil
+}
+
+// spentOutput is an undo record allowing to restore an output spent by a block
+// when the block gets disconnected.
+type spentOutput struct {
+	Txid   []byte
+	Vout   int
+	Output TXOutput
+}
+
+// Serialize encodes the outputs ordered by their index.
+func (outs TXOutputs) Serialize() ([]byte, error) {
+	indexes := make([]int, 0, len(outs.Outputs))
+	for idx := range outs.Outputs {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	var e encoder
+	e.putUint32(uint32(len(indexes)))
+	for _, idx := range indexes {
+		out := outs.Outputs[idx]
+		e.putInt64(int64(idx))
+		encodeOutput(&e, &out)
+	}
+	return e.buf, nil
+}
+
+func DeserializeOutputs(data []byte) (*TXOutputs, error) {
+	d := decoder{data: data}
+	outputs := TXOutputs{Outputs: make(map[int]TXOutput)}
+	for n := d.count(8 + minOutputSize); n > 0; n-- {
+		idx := d.int()
+		if _, ok := outputs.Outputs[idx]; ok {
+			return nil, ErrMalformedData
+		}
+		outputs.Outputs[idx] = decodeOutput(&d)
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &outputs, nil
+}
+
+func serializeUndo(undo []spentOutput) []byte {
+	var e encoder
+	e.putUint32(uint32(len(undo)))
+	for _, spent := range undo {
+		e.putBytes(spent.Txid)
+		e.putInt64(int64(spent.Vout))
+		encodeOutput(&e, &spent.Output)
+	}
+	return e.buf
+}
+
+func deserializeUndo(data []byte) ([]spentOutput, error) {
+	d := decoder{data: data}
+	var undo []spentOutput
+	for n := d.count(4 + 8 + minOutputSize); n > 0; n-- {
+		undo = append(undo, spentOutput{Txid: d.bytes(), Vout: d.int(), Output: decodeOutput(&d)})
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
+
+// ReindexUTXO drops the UTXO set together with the undo data, the height index
+// and the transaction index if it's enabled, and rebuilds them by replaying the
+// main chain from genesis. Missing headers are restored from the stored blocks.
+func (bc *Blockchain) ReindexUTXO() error {
+	hashes, err := bc.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{utxoBucket, undoBucket, heightsBucket} {
+			if err = tx.DeleteBucket([]byte(bucket)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err = tx.CreateBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		for _, bucket := range []string{metaBucket, headersBucket} {
+			if _, err = tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		if err = reindexHeaders(tx); err != nil {
+			return err
+		}
+		if tx.Bucket([]byte(txIndexBucket)) != nil {
+			if err = resetTxIndex(tx); err != nil {
+				return err
+			}
+		}
+		var parent *blockMeta
+		for height, hash := range ReverseHashes(hashes) {
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			meta := newBlockMeta(parent, bc.consensus.Weight(block))
+			if err = putBlockMeta(tx, block.Hash, meta); err != nil {
+				return err
+			}
+			if err = setMainChainBlock(tx, height, block.Hash); err != nil {
+				return err
+			}
+			if err = connectTransactions(tx, block); err != nil {
+				return err
+			}
+			parent = meta
+		}
+		return nil
+	})
+}
+
+// CountUTXOTransactions returns the number of transactions having at least one unspent output.
+func (bc *Blockchain) CountUTXOTransactions() (int, error) {
+	counter := 0
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(_, _ []byte) error {
+			counter++
+			return nil
+		})
+	})
+	return counter, err
+}
+
+// connectTransactions validates the block's transactions against the UTXO set
+// and applies them, saving the spent outputs as undo data.
+func connectTransactions(tx *bolt.Tx, block *Block) error {
+	undo, err := applyTransactions(bucketView{tx.Bucket([]byte(utxoBucket))}, block)
+	if err != nil {
+		return err
+	}
+	if err = indexTransactions(tx, block); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(undoBucket)).Put(block.Hash, serializeUndo(undo))
+}
+
+// applyTransactions validates the block's transactions against the view and
+// applies them one by one, so a transaction may spend outputs created earlier
+// in the same block. It returns the outputs spent by the block.
+func applyTransactions(view utxoView, block *Block) ([]spentOutput, error) {
+	var undo []spentOutput
+	fees := 0
+	for i, transaction := range block.Transactions {
+		if err := checkTransactionID(transaction); err != nil {
+			return nil, err
+		}
+		if !transaction.isFinal(block.Height) {
+			return nil, ErrTransactionNotFinal
+		}
+		if transaction.IsCoinbase() {
+			if i != 0 {
+				return nil, ErrIncorrectTransaction
+			}
+		} else if transaction.IsGovernance() {
+			// the signer set is kept by the consensus engine, the outputs
+			// aren't spendable. Being bound to the parent block, the same
+			// proposal can't be included twice into a chain.
+			if err := checkGovernanceTX(transaction, block.PrevBlockHash); err != nil {
+				return nil, err
+			}
+			continue
+		} else {
+			prevTXs, err := prevTransactions(view, transaction)
+			if err != nil {
+				return nil, err
+			}
+			ok, err := transaction.Verify(prevTXs)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, ErrIncorrectTransaction
+			}
+			fee, err := transactionFee(view, transaction)
+			if err != nil {
+				return nil, err
+			}
+			if fees, err = addValue(fees, fee); err != nil {
+				return nil, err
+			}
+
+			for _, vin := range transaction.Vin {
+				outs, err := view.getOutputs(vin.Txid)
+				if err != nil {
+					return nil, err
+				}
+				if _, ok := outs.Outputs[vin.Vout]; !ok {
+					return nil, ErrOutputSpent
+				}
+				undo = append(undo, spentOutput{Txid: vin.Txid, Vout: vin.Vout, Output: outs.Outputs[vin.Vout]})
+				delete(outs.Outputs, vin.Vout)
+				if err = view.putOutputs(vin.Txid, outs); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if _, err := view.getOutputs(transaction.ID); err != ErrOutputSpent {
+			if err == nil {
+				err = ErrIncorrectTransaction
+			}
+			return nil, err
+		}
+		newOutputs := TXOutputs{Outputs: make(map[int]TXOutput)}
+		for outIdx, out := range transaction.Vout {
+			newOutputs.Outputs[outIdx] = out
+		}
+		if err := view.putOutputs(transaction.ID, &newOutputs); err != nil {
+			return nil, err
+		}
+	}
+	if len(block.Transactions) > 0 && block.Transactions[0].IsCoinbase() {
+		if err := checkCoinbaseValue(block.Transactions[0], fees); err != nil {
+			return nil, err
+		}
+	}
+	return undo, nil
+}
+
+// disconnectTransactions reverts connectTransactions: outputs created by the
+// block are removed and the outputs it spent are restored from the undo data.
+func disconnectTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	ub := tx.Bucket([]byte(undoBucket))
+	data := ub.Get(block.Hash)
+	if data == nil {
+		return ErrBlockNotFound
+	}
+	undo, err := deserializeUndo(data)
+	if err != nil {
+		return err
+	}
+
+	u := len(undo)
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		transaction := block.Transactions[i]
+		if err := b.Delete(transaction.ID); err != nil {
+			return err
+		}
+		if transaction.IsCoinbase() || transaction.IsGovernance() {
+			continue
+		}
+		for range transaction.Vin {
+			u--
+			if u < 0 {
+				return ErrIncorrectTransaction
+			}
+			spent := undo[u]
+			outs := &TXOutputs{Outputs: make(map[int]TXOutput)}
+			if data := b.Get(spent.Txid); data != nil {
+				var err error
+				if outs, err = DeserializeOutputs(data); err != nil {
+					return err
+				}
+			}
+			outs.Outputs[spent.Vout] = spent.Output
+			if err := putOutputs(b, spent.Txid, outs); err != nil {
+				return err
+			}
+		}
+	}
+	if err = unindexTransactions(tx, block); err != nil {
+		return err
+	}
+	return ub.Delete(block.Hash)
+}
+
+// getOutputs returns unspent outputs of the transaction failing with
+// ErrOutputSpent if there are none.
+func getOutputs(b *bolt.Bucket, txID []byte) (*TXOutputs, error) {
+	data := b.Get(txID)
+	if data == nil {
+		return nil, ErrOutputSpent
+	}
+	return DeserializeOutputs(data)
+}
+
+func putOutputs(b *bolt.Bucket, txID []byte, outs *TXOutputs) error {
+	if len(outs.Outputs) == 0 {
+		return b.Delete(txID)
+	}
+	serialized, err := outs.Serialize()
+	if err != nil {
+		return err
+	}
+	return b.Put(txID, serialized)
+}
+
+// prevTransactions rebuilds the previous transactions referenced by the inputs
+// from the UTXO set. Only unspent outputs are filled in, which is all that
+// Transaction.Verify needs.
+func prevTransactions(view utxoView, transaction *Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+	for _, vin := range transaction.Vin {
+		outs, err := view.getOutputs(vin.Txid)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := outs.Outputs[vin.Vout]; !ok {
+			return nil, ErrOutputSpent
+		}
+		maxIdx := 0
+		for idx := range outs.Outputs {
+			if idx > maxIdx {
+				maxIdx = idx
+			}
+		}
+		prevTX := Transaction{ID: vin.Txid, Vout: make([]TXOutput, maxIdx+1)}
+		for idx, out := range outs.Outputs {
+			prevTX.Vout[idx] = out
+		}
+		prevTXs[hex.EncodeToString(vin.Txid)] = prevTX
+	}
+	return prevTXs, nil
+}
+
+func (bc *Blockchain) FindUTXO(pubKeyHash []byte) ([]TXOutput, error) {
+	var UTXOs []TXOutput
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(_, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+			for _, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					UTXOs = append(UTXOs, out)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return UTXOs, nil
+}
+
+// GetBalance sums the unspent outputs locked to the address.
+func (bc *Blockchain) GetBalance(address string) (int, error) {
+	pubKeyHash, err := lockingHashFromAddress(address)
+	if err != nil {
+		return 0, err
+	}
+	UTXOs, err := bc.FindUTXO(pubKeyHash)
+	if err != nil {
+		return 0, err
+	}
+	balance := 0
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+	return balance, nil
+}
+
+// SpendableOutputs lists the unspent outputs locked to the public key hash, a
+// CoinSelector then picks the ones to spend.
+func (bc *Blockchain) SpendableOutputs(pubKeyHash []byte) ([]SpendableOutput, error) {
+	var spendable []SpendableOutput
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+			for outIdx, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					txID := append([]byte{}, k...)
+					spendable = append(spendable, SpendableOutput{Txid: txID, Vout: outIdx, Value: out.Value})
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spendable, nil
+}
+
+// TransactionFee returns the difference between the value of the transaction's
+// inputs, looked up in the UTXO set, and the value of its outputs.
+func (bc *Blockchain) TransactionFee(transaction *Transaction) (int, error) {
+	var fee int
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		fee, err = transactionFee(bucketView{tx.Bucket([]byte(utxoBucket))}, transaction)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fee, nil
+}
+
+func transactionFee(view utxoView, transaction *Transaction) (int, error) {
+	if transaction.IsCoinbase() || transaction.IsGovernance() {
+		return 0, nil
+	}
+	inputs := 0
+	for _, vin := range transaction.Vin {
+		outs, err := view.getOutputs(vin.Txid)
+		if err != nil {
+			return 0, err
+		}
+		out, ok := outs.Outputs[vin.Vout]
+		if !ok {
+			return 0, ErrOutputSpent
+		}
+		if inputs, err = addValue(inputs, out.Value); err != nil {
+			return 0, err
+		}
+	}
+	return feeOf(transaction, inputs)
+}
+
+// feeOf returns what's left of the inputs' value once the outputs are paid.
+func feeOf(transaction *Transaction, inputs int) (int, error) {
+	outputs, err := transaction.OutputsValue()
+	if err != nil {
+		return 0, err
+	}
+	if outputs > inputs {
+		return 0, ErrInsufficientFee
+	}
+	return inputs - outputs, nil
+}
+
+// checkCoinbaseValue makes sure the coinbase pays no more than the subsidy and
+// the fees of the block.
+func checkCoinbaseValue(coinbase *Transaction, fees int) error {
+	reward, err := addValue(netParams.Subsidy, fees)
+	if err != nil {
+		return err
+	}
+	value, err := coinbase.OutputsValue()
+	if err != nil {
+		return err
+	}
+	if value > reward {
+		return ErrCoinbaseOverpay
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestChain creates a regtest chain in a temporary directory, the genesis
+// block paying to the returned wallet.
+func newTestChain(t *testing.T) (*Blockchain, *Wallet, string) {
+	SetDataDir(t.TempDir())
+	SetNetwork(&RegTestParams)
+	t.Cleanup(func() {
+		SetNetwork(&MainNetParams)
+	})
+	wallet, address := newTestAddress(t)
+	_, err := CreateBlockchain(address)
+	require.NoError(t, err)
+	bc, err := GetBlockchain()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, bc.db.Close())
+	})
+	return bc, wallet, address
+}
+
+func TestReindexUTXO(t *testing.T) {
+	bc, wallet, from := newTestChain(t)
+	_, to := newTestAddress(t)
+	_, err := bc.Generate(context.Background(), 3, from)
+	require.NoError(t, err)
+	tx, err := CreateUTXOTransaction(wallet, to, 15, 2, nil, bc)
+	require.NoError(t, err)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{tx})
+	require.NoError(t, err)
+
+	utxos := make(map[string][]TXOutput)
+	balances := make(map[string]int)
+	for _, address := range []string{from, to} {
+		pubKeyHash, err := pubKeyHashFromAddress(address)
+		require.NoError(t, err)
+		utxos[address], err = bc.FindUTXO(pubKeyHash)
+		require.NoError(t, err)
+		balances[address], err = bc.GetBalance(address)
+		require.NoError(t, err)
+	}
+	require.Equal(t, map[string]int{from: 40 - 17, to: 15}, balances)
+	count, err := bc.CountUTXOTransactions()
+	require.NoError(t, err)
+
+	require.NoError(t, bc.ReindexUTXO())
+	for _, address := range []string{from, to} {
+		pubKeyHash, err := pubKeyHashFromAddress(address)
+		require.NoError(t, err)
+		reindexed, err := bc.FindUTXO(pubKeyHash)
+		require.NoError(t, err)
+		require.ElementsMatch(t, utxos[address], reindexed)
+		balance, err := bc.GetBalance(address)
+		require.NoError(t, err)
+		require.Equal(t, balances[address], balance)
+	}
+	reindexedCount, err := bc.CountUTXOTransactions()
+	require.NoError(t, err)
+	require.Equal(t, count, reindexedCount)
+}
+
+func TestTransactionFees(t *testing.T) {
+	bc, wallet, from := newTestChain(t)
+	_, to := newTestAddress(t)
+	_, miner := newTestAddress(t)
+	_, err := bc.Generate(context.Background(), 1, from)
+	require.NoError(t, err)
+
+	tx, err := CreateUTXOTransaction(wallet, to, 5, 2, nil, bc)
+	require.NoError(t, err)
+	fee, err := bc.TransactionFee(tx)
+	require.NoError(t, err)
+	require.Equal(t, 2, fee)
+
+	overpay, err := CreateCoinbaseTX(miner, "", fee+1)
+	require.NoError(t, err)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{overpay, tx})
+	require.ErrorIs(t, err, ErrCoinbaseOverpay)
+
+	cbTx, err := CreateCoinbaseTX(miner, "", fee)
+	require.NoError(t, err)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{cbTx, tx})
+	require.NoError(t, err)
+	balance, err := bc.GetBalance(miner)
+	require.NoError(t, err)
+	require.Equal(t, netParams.Subsidy+fee, balance)
+	require.NoError(t, bc.Validate(context.Background()))
+}
+
+func TestOutputsValueOverflow(t *testing.T) {
+	bc, wallet, from := newTestChain(t)
+	_, to := newTestAddress(t)
+
+	cbTx, err := CreateCoinbaseTX(from, "", 0)
+	require.NoError(t, err)
+	cbTx.Vout = []TXOutput{newTestOutput(t, maxInt, from), newTestOutput(t, 1, from)}
+	cbTx.ID, err = cbTx.Hash()
+	require.NoError(t, err)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{cbTx})
+	require.ErrorIs(t, err, ErrAmountOverflow)
+	_, err = cbTx.OutputsValue()
+	require.ErrorIs(t, err, ErrAmountOverflow)
+
+	// outputs wrapping around to a small total would leave a large fee
+	tx, err := CreateUTXOTransaction(wallet, to, 5, 0, nil, bc)
+	require.NoError(t, err)
+	tx.Vout = []TXOutput{newTestOutput(t, maxInt, to), newTestOutput(t, maxInt, to), newTestOutput(t, 3, to)}
+	require.NoError(t, bc.SignTransaction(tx, wallet.PrivateKey))
+	_, err = bc.TransactionFee(tx)
+	require.ErrorIs(t, err, ErrAmountOverflow)
+
+	tx.Vout = []TXOutput{newTestOutput(t, -1, to), newTestOutput(t, 6, to)}
+	require.NoError(t, bc.SignTransaction(tx, wallet.PrivateKey))
+	_, err = bc.TransactionFee(tx)
+	require.ErrorIs(t, err, ErrIncorrectTransaction)
+	cbTx, err = CreateCoinbaseTX(from, "", 0)
+	require.NoError(t, err)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{cbTx, tx})
+	require.ErrorIs(t, err, ErrIncorrectTransaction)
+}
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+var ErrBrokenLink = errors.New("err previous hash doesn't match previous block")
+var ErrInvalidProofOfWork = errors.New("err invalid proof of work")
+var ErrInvalidSignature = errors.New("err invalid transaction signature")
+var ErrMisplacedCoinbase = errors.New("err coinbase is not the first transaction")
+var ErrBadMerkleRoot = errors.New("err merkle root doesn't match transactions")
+var ErrDuplicateTransaction = errors.New("err block contains a transaction more than once")
+var ErrBadHeight = errors.New("err block height doesn't match its position in the chain")
+
+// BlockValidationError describes the first invalid block found by Validate.
+// TxID is set when the problem is in one of the block's transactions.
+type BlockValidationError struct {
+	Height int
+	Hash   []byte
+	TxID   []byte
+	Err    error
+}
+
+func (e *BlockValidationError) Error() string {
+	if e.TxID != nil {
+		return fmt.Sprintf("block %d (%x), transaction %x: %s", e.Height, e.Hash, e.TxID, e.Err)
+	}
+	return fmt.Sprintf("block %d (%x): %s", e.Height, e.Hash, e.Err)
+}
+
+func (e *BlockValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate replays the main chain, as recorded by the height index, from
+// genesis to the tip independently of the stored UTXO set, checking block
+// links, block seals, merkle roots, transaction signatures, double spends and
+// coinbase amounts.
+func (bc *Blockchain) Validate(ctx context.Context) error {
+	return bc.db.View(func(tx *bolt.Tx) error {
+		transactions := make(map[string]*Transaction)
+		spent := make(map[string]bool)
+		var prevHash []byte
+
+		for height := 0; ; height++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			hash, err := getHashByHeight(tx, height)
+			if err == ErrBlockNotFound {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			invalid := func(txID []byte, err error) error {
+				return &BlockValidationError{Height: height, Hash: block.Hash, TxID: txID, Err: err}
+			}
+
+			if !bytes.Equal(block.PrevBlockHash, prevHash) {
+				return invalid(nil, ErrBrokenLink)
+			}
+			if block.Height != height {
+				return invalid(nil, ErrBadHeight)
+			}
+			if err := bc.consensus.Verify(txChainReader{tx}, block); err != nil {
+				return invalid(nil, err)
+			}
+			if !block.hasValidMerkleRoot() {
+				return invalid(nil, ErrBadMerkleRoot)
+			}
+			if block.hasDuplicateTransactions() {
+				return invalid(nil, ErrDuplicateTransaction)
+			}
+
+			fees := 0
+			for i, transaction := range block.Transactions {
+				if err := checkTransactionID(transaction); err != nil {
+					return invalid(transaction.ID, err)
+				}
+				if !transaction.isFinal(height) {
+					return invalid(transaction.ID, ErrTransactionNotFinal)
+				}
+				if transaction.IsCoinbase() {
+					if i != 0 {
+						return invalid(transaction.ID, ErrMisplacedCoinbase)
+					}
+				} else if transaction.IsGovernance() {
+					// the outputs aren't spendable, so the transaction isn't
+					// recorded for the later ones to spend
+					if err := checkGovernanceTX(transaction, block.PrevBlockHash); err != nil {
+						return invalid(transaction.ID, err)
+					}
+					continue
+				} else {
+					fee, err := validateReplayedTransaction(transaction, transactions, spent)
+					if err != nil {
+						return invalid(transaction.ID, err)
+					}
+					if fees, err = addValue(fees, fee); err != nil {
+						return invalid(transaction.ID, err)
+					}
+				}
+				txID := hex.EncodeToString(transaction.ID)
+				if _, ok := transactions[txID]; ok {
+					return invalid(transaction.ID, ErrIncorrectTransaction)
+				}
+				transactions[txID] = transaction
+			}
+			if len(block.Transactions) > 0 && block.Transactions[0].IsCoinbase() {
+				if err := checkCoinbaseValue(block.Transactions[0], fees); err != nil {
+					return invalid(block.Transactions[0].ID, err)
+				}
+			}
+			prevHash = block.Hash
+		}
+		if !bytes.Equal(prevHash, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))) {
+			return fmt.Errorf("%w: main chain doesn't end at the tip", ErrBrokenLink)
+		}
+		return nil
+	})
+}
+
+// validateReplayedTransaction checks the transaction against the transactions
+// seen so far, marks its inputs as spent and returns its fee.
+func validateReplayedTransaction(transaction *Transaction, transactions map[string]*Transaction, spent map[string]bool) (int, error) {
+	prevTXs := make(map[string]Transaction)
+	inputs := 0
+	for _, vin := range transaction.Vin {
+		prevTX, ok := transactions[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return 0, ErrTransactionNotFound
+		}
+		if spent[vin.outpoint()] {
+			return 0, ErrOutputSpent
+		}
+		spent[vin.outpoint()] = true
+		var err error
+		if inputs, err = addValue(inputs, prevTX.Vout[vin.Vout].Value); err != nil {
+			return 0, err
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = *prevTX
+	}
+	ok, err := transaction.Verify(prevTXs)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrInvalidSignature
+	}
+	return feeOf(transaction, inputs)
+}
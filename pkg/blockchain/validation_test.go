@@ -0,0 +1,110 @@
+package blockchain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+// storeBlock writes the block as the new tip of the main chain without
+// checking or connecting it.
+func storeBlock(t *testing.T, bc *Blockchain, block *Block) {
+	require.NoError(t, bc.db.Update(func(tx *bolt.Tx) error {
+		if err := putBlock(tx, block); err != nil {
+			return err
+		}
+		if err := setMainChainBlock(tx, block.Height, block.Hash); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.Hash)
+	}))
+	bc.mu.Lock()
+	bc.tip = block.Hash
+	bc.mu.Unlock()
+}
+
+func requireInvalidBlock(t *testing.T, bc *Blockchain, height int, expected error) {
+	err := bc.Validate(context.Background())
+	require.ErrorIs(t, err, expected)
+	var validationErr *BlockValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, height, validationErr.Height)
+}
+
+func TestValidate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		bc, wallet, _ := newTestChain(t)
+		_, to := newTestAddress(t)
+		tx, err := CreateUTXOTransaction(wallet, to, 4, 1, nil, bc)
+		require.NoError(t, err)
+		cbTx, err := CreateCoinbaseTX(to, "", 1)
+		require.NoError(t, err)
+		_, err = bc.MineBlock(context.Background(), []*Transaction{cbTx, tx})
+		require.NoError(t, err)
+		require.NoError(t, bc.Validate(context.Background()))
+	})
+
+	t.Run("bad link", func(t *testing.T) {
+		bc, _, address := newTestChain(t)
+		genesis, err := bc.GetBlock(bc.Tip())
+		require.NoError(t, err)
+		side := mineOn(t, bc, genesis, address)
+		_, err = bc.Generate(context.Background(), 2, address)
+		require.NoError(t, err)
+		require.NoError(t, bc.db.Update(func(tx *bolt.Tx) error {
+			if err := putBlock(tx, side); err != nil {
+				return err
+			}
+			return setMainChainBlock(tx, 1, side.Hash)
+		}))
+		requireInvalidBlock(t, bc, 2, ErrBrokenLink)
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		bc, wallet, address := newTestChain(t)
+		_, to := newTestAddress(t)
+		tip, err := bc.GetBlock(bc.Tip())
+		require.NoError(t, err)
+		tx, err := CreateUTXOTransaction(wallet, to, 4, 0, nil, bc)
+		require.NoError(t, err)
+		signature, pubKey, err := parseUnlockingScript(tx.Vin[0].UnlockingScript)
+		require.NoError(t, err)
+		signature[0] ^= 0xff
+		tx.Vin[0].UnlockingScript = unlockingScript(signature, pubKey)
+		tx.ID, err = tx.Hash()
+		require.NoError(t, err)
+		storeBlock(t, bc, mineOn(t, bc, tip, address, tx))
+		requireInvalidBlock(t, bc, 1, ErrInvalidSignature)
+	})
+
+	t.Run("double spend", func(t *testing.T) {
+		bc, wallet, address := newTestChain(t)
+		_, to := newTestAddress(t)
+		tip, err := bc.GetBlock(bc.Tip())
+		require.NoError(t, err)
+		tx, err := CreateUTXOTransaction(wallet, to, 4, 0, nil, bc)
+		require.NoError(t, err)
+		double, err := CreateUTXOTransaction(wallet, to, 5, 0, nil, bc)
+		require.NoError(t, err)
+		require.Equal(t, tx.Vin[0].outpoint(), double.Vin[0].outpoint())
+		first := mineOn(t, bc, tip, address, tx)
+		storeBlock(t, bc, first)
+		storeBlock(t, bc, mineOn(t, bc, first, address, double))
+		requireInvalidBlock(t, bc, 2, ErrOutputSpent)
+	})
+
+	t.Run("overpaying coinbase", func(t *testing.T) {
+		bc, _, address := newTestChain(t)
+		tip, err := bc.GetBlock(bc.Tip())
+		require.NoError(t, err)
+		cbTx, err := CreateCoinbaseTX(address, "", 1)
+		require.NoError(t, err)
+		block := NewBlock([]*Transaction{cbTx}, tip.Hash, 1)
+		require.NoError(t, bc.consensus.Prepare(bc, block))
+		require.NoError(t, bc.consensus.Seal(context.Background(), block))
+		storeBlock(t, bc, block)
+		requireInvalidBlock(t, bc, 1, ErrCoinbaseOverpay)
+	})
+}
@@ -0,0 +1,259 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+)
+
+var ErrStackUnderflow = errors.New("err script stack underflow")
+var ErrUnbalancedConditional = errors.New("err unbalanced conditional in script")
+var ErrLockTimeNotReached = errors.New("err output locked until a later height")
+
+// scriptVM runs the scripts of a transaction's input. Signatures are checked
+// against hash, the signature hash of the input.
+type scriptVM struct {
+	stack [][]byte
+	tx    *Transaction
+	hash  []byte
+}
+
+func (vm *scriptVM) push(data []byte) error {
+	if len(data) > maxScriptElementSize || len(vm.stack) >= maxStackSize {
+		return ErrInvalidScript
+	}
+	vm.stack = append(vm.stack, data)
+	return nil
+}
+
+func (vm *scriptVM) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, ErrStackUnderflow
+	}
+	data := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return data, nil
+}
+
+func (vm *scriptVM) popInt() (int64, error) {
+	data, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data, maxScriptNumLen)
+}
+
+// execute runs the script on the current stack. Instructions within an IF or
+// ELSE branch whose condition doesn't hold are skipped.
+func (vm *scriptVM) execute(script []byte) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+	var conditions []bool
+	for _, op := range ops {
+		executing := true
+		for _, c := range conditions {
+			executing = executing && c
+		}
+		switch op.opcode {
+		case OpIf, OpNotIf:
+			condition := false
+			if executing {
+				data, err := vm.pop()
+				if err != nil {
+					return err
+				}
+				condition = isTrue(data) == (op.opcode == OpIf)
+			}
+			conditions = append(conditions, condition)
+			continue
+		case OpElse:
+			if len(conditions) == 0 {
+				return ErrUnbalancedConditional
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+		case OpEndIf:
+			if len(conditions) == 0 {
+				return ErrUnbalancedConditional
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+		if !executing {
+			continue
+		}
+		if err := vm.step(op); err != nil {
+			return err
+		}
+	}
+	if len(conditions) != 0 {
+		return ErrUnbalancedConditional
+	}
+	return nil
+}
+
+func (vm *scriptVM) step(op scriptOp) error {
+	switch {
+	case op.opcode <= OpPushData2:
+		return vm.push(op.data)
+	case op.opcode >= Op1 && op.opcode <= Op16:
+		return vm.push(encodeScriptNum(int64(op.opcode - Op1 + 1)))
+	}
+	switch op.opcode {
+	case OpVerify:
+		data, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if !isTrue(data) {
+			return ErrScriptFailed
+		}
+	case OpDrop:
+		_, err := vm.pop()
+		return err
+	case OpDup:
+		if len(vm.stack) == 0 {
+			return ErrStackUnderflow
+		}
+		return vm.push(vm.stack[len(vm.stack)-1])
+	case OpEqual, OpEqualVerify:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if op.opcode == OpEqualVerify {
+			if !bytes.Equal(a, b) {
+				return ErrScriptFailed
+			}
+			return nil
+		}
+		return vm.push(boolData(bytes.Equal(a, b)))
+	case OpHash160:
+		data, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		hash, err := HashPubKey(data)
+		if err != nil {
+			return err
+		}
+		return vm.push(hash)
+	case OpCheckSig:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.push(boolData(verifyHash(pubKey, vm.hash, signature)))
+	case OpCheckMultisig:
+		return vm.checkMultisig()
+	case OpCheckLockTimeVerify:
+		if len(vm.stack) == 0 {
+			return ErrStackUnderflow
+		}
+		lockTime, err := decodeScriptNum(vm.stack[len(vm.stack)-1], maxLockTimeNumLen)
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 {
+			return ErrScriptFailed
+		}
+		if lockTime > int64(vm.tx.LockTime) {
+			return ErrLockTimeNotReached
+		}
+	default:
+		return ErrInvalidScript
+	}
+	return nil
+}
+
+// checkMultisig pops n, n public keys, m and m signatures, which have to be
+// valid signatures of m of the keys in the order of the keys.
+func (vm *scriptVM) checkMultisig() error {
+	n, err := vm.popInt()
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > maxMultisigKeys {
+		return ErrInvalidScript
+	}
+	pubKeys := make([][]byte, n)
+	for i := len(pubKeys) - 1; i >= 0; i-- {
+		if pubKeys[i], err = vm.pop(); err != nil {
+			return err
+		}
+	}
+	m, err := vm.popInt()
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return ErrInvalidScript
+	}
+	signatures := make([][]byte, m)
+	for i := len(signatures) - 1; i >= 0; i-- {
+		if signatures[i], err = vm.pop(); err != nil {
+			return err
+		}
+	}
+	key := 0
+	for _, signature := range signatures {
+		for key < len(pubKeys) && !verifyHash(pubKeys[key], vm.hash, signature) {
+			key++
+		}
+		if key == len(pubKeys) {
+			return vm.push(boolData(false))
+		}
+		key++
+	}
+	return vm.push(boolData(true))
+}
+
+func (vm *scriptVM) succeeded() bool {
+	return len(vm.stack) > 0 && isTrue(vm.stack[len(vm.stack)-1])
+}
+
+// verifyScripts runs the unlocking script of the transaction's input and then
+// the locking script of the output it spends. For pay to script hash outputs
+// the script pushed last by the unlocking script is run as well, on the rest of
+// the data it pushed.
+func verifyScripts(tx *Transaction, unlocking, locking, hash []byte) error {
+	data, err := pushedData(unlocking)
+	if err != nil {
+		return err
+	}
+	vm := scriptVM{tx: tx, hash: hash}
+	for _, d := range data {
+		if err := vm.push(d); err != nil {
+			return err
+		}
+	}
+	if err := vm.execute(locking); err != nil {
+		return err
+	}
+	if !vm.succeeded() {
+		return ErrScriptFailed
+	}
+	if payToScriptHash(locking) == nil {
+		return nil
+	}
+	if len(data) == 0 {
+		return ErrScriptFailed
+	}
+	vm.stack = append([][]byte{}, data[:len(data)-1]...)
+	if err := vm.execute(data[len(data)-1]); err != nil {
+		return err
+	}
+	if !vm.succeeded() {
+		return ErrScriptFailed
+	}
+	return nil
+}
@@ -1,18 +1,20 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"golang.org/x/crypto/ripemd160"
+	"math/big"
 )
 
-const (
-	version            = byte(0x00)
-	walletFile         = "wallet.dat"
-	addressChecksumLen = 4
-)
+const addressChecksumLen = 4
+
+var ErrInvalidPrivateKey = errors.New("err invalid private key")
+var ErrInvalidAddress = errors.New("err invalid address")
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
@@ -33,8 +35,61 @@ func newKeyPair() (*ecdsa.PrivateKey, []byte, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return private, pubKey, nil
+	return private, publicKeyBytes(&private.PublicKey), nil
+}
+
+// walletFromPrivateKey restores the key pair from the private scalar.
+func walletFromPrivateKey(d []byte) (*Wallet, error) {
+	curve := elliptic.P256()
+	k := new(big.Int).SetBytes(d)
+	if k.Sign() == 0 || k.Cmp(curve.Params().N) >= 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+	private := ecdsa.PrivateKey{D: k}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(k.FillBytes(make([]byte, 32)))
+	return &Wallet{private, publicKeyBytes(&private.PublicKey)}, nil
+}
+
+// publicKeyBytes encodes the public key as X and Y coordinates padded to 32
+// bytes each, so the key can be split in halves.
+func publicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	pubKey := make([]byte, 64)
+	pub.X.FillBytes(pubKey[:32])
+	pub.Y.FillBytes(pubKey[32:])
+	return pubKey
+}
+
+// signHash signs the hash with the private key, the signature being r and s
+// padded to 32 bytes each.
+func signHash(priv *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, priv, hash)
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+// verifyHash checks a signature made by signHash against a public key encoded
+// by publicKeyBytes.
+func verifyHash(pubKey, hash, signature []byte) bool {
+	if len(pubKey) != 64 || len(signature) != 64 {
+		return false
+	}
+	pub := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(pubKey[:32]),
+		Y:     new(big.Int).SetBytes(pubKey[32:]),
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(&pub, hash, r, s)
 }
 
 func (w *Wallet) GetAddress() ([]byte, error) {
@@ -43,12 +98,19 @@ func (w *Wallet) GetAddress() ([]byte, error) {
 		return nil, err
 	}
 
-	versionPayload := append([]byte{version}, pubKeyHash...)
+	return addressFromPubKeyHash(pubKeyHash), nil
+}
+
+func addressFromPubKeyHash(pubKeyHash []byte) []byte {
+	return encodeAddress(netParams.AddressVersion, pubKeyHash)
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	versionPayload := append([]byte{version}, hash...)
 	checksum := checksum(versionPayload)
 
 	fullPayLoad := append(versionPayload, checksum...)
-	address := Base58Encode(fullPayLoad)
-	return address, nil
+	return Base58Encode(fullPayLoad)
 }
 
 func HashPubKey(pubkey []byte) ([]byte, error) {
@@ -61,6 +123,44 @@ func HashPubKey(pubkey []byte) ([]byte, error) {
 	return publicRIPEMD160, nil
 }
 
+// pubKeyHashFromAddress decodes the address of a single key checking its
+// version and checksum.
+func pubKeyHashFromAddress(address string) ([]byte, error) {
+	version, hash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if version != netParams.AddressVersion {
+		return nil, ErrInvalidAddress
+	}
+	return hash, nil
+}
+
+// lockingHashFromAddress decodes an address outputs can be locked to, either
+// of a single key or a multisig one.
+func lockingHashFromAddress(address string) ([]byte, error) {
+	version, hash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if version != netParams.AddressVersion && version != netParams.MultisigVersion || len(hash) != ripemd160.Size {
+		return nil, ErrInvalidAddress
+	}
+	return hash, nil
+}
+
+func decodeAddress(address string) (byte, []byte, error) {
+	payload := Base58Decode([]byte(address))
+	if len(payload) <= addressChecksumLen+1 {
+		return 0, nil, ErrInvalidAddress
+	}
+	versionPayload := payload[:len(payload)-addressChecksumLen]
+	if !bytes.Equal(checksum(versionPayload), payload[len(payload)-addressChecksumLen:]) {
+		return 0, nil, ErrInvalidAddress
+	}
+	return versionPayload[0], versionPayload[1:], nil
+}
+
 func checksum(payload []byte) []byte {
 	firstSHA := sha256.Sum256(payload)
 	secondSHA := sha256.Sum256(firstSHA[:])
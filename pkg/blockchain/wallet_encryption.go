@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters recommended for interactive logins
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+var encryptedWalletMagic = []byte("bcwallet-enc-v1\x00")
+
+var ErrWalletLocked = errors.New("err wallet is encrypted, passphrase required")
+var ErrWrongPassphrase = errors.New("err wrong passphrase")
+var ErrEmptyPassphrase = errors.New("err passphrase is empty")
+var ErrWalletEncrypted = errors.New("err wallet is already encrypted")
+var ErrWalletNotEncrypted = errors.New("err wallet is not encrypted")
+
+// encryptedWallet is the content of an encrypted wallet file following the
+// magic prefix. The key is derived from the passphrase with scrypt and the
+// plaintext wallet is sealed with AES-256-GCM.
+type encryptedWallet struct {
+	Salt       []byte
+	N, R, P    int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func isEncryptedWallet(content []byte) bool {
+	return bytes.HasPrefix(content, encryptedWalletMagic)
+}
+
+func encryptWallet(plaintext []byte, passphrase string) ([]byte, error) {
+	enc := encryptedWallet{Salt: make([]byte, saltLen), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := rand.Read(enc.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := walletCipher(passphrase, &enc)
+	if err != nil {
+		return nil, err
+	}
+	enc.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(enc.Nonce); err != nil {
+		return nil, err
+	}
+	enc.Ciphertext = aead.Seal(nil, enc.Nonce, plaintext, encryptedWalletMagic)
+
+	content := bytes.NewBuffer(append([]byte{}, encryptedWalletMagic...))
+	if err = gob.NewEncoder(content).Encode(enc); err != nil {
+		return nil, err
+	}
+	return content.Bytes(), nil
+}
+
+func decryptWallet(content []byte, passphrase string) ([]byte, error) {
+	var enc encryptedWallet
+	payload := bytes.NewReader(content[len(encryptedWalletMagic):])
+	if err := gob.NewDecoder(payload).Decode(&enc); err != nil {
+		return nil, err
+	}
+	aead, err := walletCipher(passphrase, &enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc.Nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := aead.Open(nil, enc.Nonce, enc.Ciphertext, encryptedWalletMagic)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func walletCipher(passphrase string, enc *encryptedWallet) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), enc.Salt, enc.N, enc.R, enc.P, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -2,22 +2,60 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
 )
 
+const defaultGapLimit = 20
+
 var ErrNoSuchWallet = errors.New("err no such wallet")
+var ErrHDAlreadyInitialized = errors.New("err wallet already has a seed")
 
+// Wallets holds the keys of the wallet file. When seed is set, new keys are
+// derived from it along the m/0'/i' path, i being nextIndex.
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	passphrase string
+	seed       []byte
+	nextIndex  uint32
+}
+
+// walletsData is the representation of Wallets in the wallet file, private
+// keys are stored as their scalars.
+type walletsData struct {
+	Keys      map[string][]byte
+	Seed      []byte
+	NextIndex uint32
+}
+
+// legacyWallets matches the gob encoded Wallets of plaintext wallet files
+// written before walletsData. Only the private scalars are decoded, the rest of
+// the keys is derived from them.
+type legacyWallets struct {
+	Wallets map[string]*legacyWallet
+}
+
+type legacyWallet struct {
+	PrivateKey struct {
+		D *big.Int
+	}
 }
 
 func GetWallets() (*Wallets, error) {
-	wallets := Wallets{}
+	return LoadWallets("")
+}
+
+// LoadWallets reads the wallet file decrypting it with the passphrase if it is
+// encrypted. The passphrase is kept to encrypt the file again on save.
+func LoadWallets(passphrase string) (*Wallets, error) {
+	wallets := Wallets{passphrase: passphrase}
 	wallets.Wallets = make(map[string]*Wallet)
 	if err := wallets.LoadFromFile(); err != nil {
 		return nil, err
@@ -26,7 +64,13 @@ func GetWallets() (*Wallets, error) {
 }
 
 func (ws *Wallets) CreateWallet() (string, error) {
-	wallet, err := CreateWallet()
+	var wallet *Wallet
+	var err error
+	if ws.IsHD() {
+		wallet, err = ws.nextHDWallet()
+	} else {
+		wallet, err = CreateWallet()
+	}
 	if err != nil {
 		return "", err
 	}
@@ -38,6 +82,112 @@ func (ws *Wallets) CreateWallet() (string, error) {
 	return string(address), nil
 }
 
+func (ws *Wallets) IsHD() bool {
+	return len(ws.seed) > 0
+}
+
+// InitHD switches the wallet to the deterministic mode, all the following keys
+// are derived from the seed.
+func (ws *Wallets) InitHD(seed []byte) error {
+	if ws.IsHD() {
+		return ErrHDAlreadyInitialized
+	}
+	if _, err := NewMasterKey(seed); err != nil {
+		return err
+	}
+	ws.seed = seed
+	ws.nextIndex = 0
+	return nil
+}
+
+// InitMnemonic switches the wallet to the deterministic mode with a seed made
+// from a new mnemonic, which is returned to be backed up.
+func (ws *Wallets) InitMnemonic() (string, error) {
+	if ws.IsHD() {
+		return "", ErrHDAlreadyInitialized
+	}
+	entropy, err := NewEntropy(256)
+	if err != nil {
+		return "", err
+	}
+	mnemonic, err := NewMnemonic(entropy)
+	if err != nil {
+		return "", err
+	}
+	seed, err := NewSeed(mnemonic, "")
+	if err != nil {
+		return "", err
+	}
+	return mnemonic, ws.InitHD(seed)
+}
+
+func (ws *Wallets) deriveHDWallet(index uint32) (*Wallet, error) {
+	master, err := NewMasterKey(ws.seed)
+	if err != nil {
+		return nil, err
+	}
+	key, err := master.Derive(HardenedKeyStart, HardenedKeyStart+index)
+	if err != nil {
+		return nil, err
+	}
+	return key.Wallet()
+}
+
+func (ws *Wallets) nextHDWallet() (*Wallet, error) {
+	for ws.nextIndex < HardenedKeyStart {
+		wallet, err := ws.deriveHDWallet(ws.nextIndex)
+		ws.nextIndex++
+		if err == ErrInvalidChildKey {
+			continue
+		}
+		return wallet, err
+	}
+	return nil, ErrInvalidChildKey
+}
+
+// RecoverHD derives keys from the seed until gapLimit consecutive addresses
+// haven't received coins on the chain and adds them all, so the unused
+// addresses handed out after the last used one are restored as well. Returns
+// the number of used addresses.
+func (ws *Wallets) RecoverHD(bc *Blockchain, gapLimit int) (int, error) {
+	if !ws.IsHD() {
+		return 0, ErrInvalidSeed
+	}
+	used, err := bc.UsedPubKeyHashes()
+	if err != nil {
+		return 0, err
+	}
+	recovered := 0
+	for index, gap := uint32(0), 0; gap < gapLimit && index < HardenedKeyStart; index++ {
+		wallet, err := ws.deriveHDWallet(index)
+		if err == ErrInvalidChildKey {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		pubKeyHash, err := HashPubKey(wallet.PublicKey)
+		if err != nil {
+			return 0, err
+		}
+		address, err := wallet.GetAddress()
+		if err != nil {
+			return 0, err
+		}
+		ws.Wallets[string(address)] = wallet
+		if index >= ws.nextIndex {
+			ws.nextIndex = index + 1
+		}
+		if !used[hex.EncodeToString(pubKeyHash)] {
+			gap++
+			continue
+		}
+		gap = 0
+		recovered++
+	}
+	return recovered, nil
+}
+
 func (ws *Wallets) GetAddresses() []string {
 	var addresses []string
 	for address := range ws.Wallets {
@@ -54,32 +204,130 @@ func (ws *Wallets) GetWallet(address string) (*Wallet, error) {
 	return wallet, nil
 }
 
+func (ws *Wallets) IsEncrypted() bool {
+	return ws.passphrase != ""
+}
+
+// Encrypt sets the passphrase the wallet file is encrypted with on save.
+func (ws *Wallets) Encrypt(passphrase string) error {
+	if ws.IsEncrypted() {
+		return ErrWalletEncrypted
+	}
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+	ws.passphrase = passphrase
+	return nil
+}
+
+func (ws *Wallets) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	if !ws.IsEncrypted() {
+		return ErrWalletNotEncrypted
+	}
+	if oldPassphrase != ws.passphrase {
+		return ErrWrongPassphrase
+	}
+	if newPassphrase == "" {
+		return ErrEmptyPassphrase
+	}
+	ws.passphrase = newPassphrase
+	return nil
+}
+
 func (ws *Wallets) LoadFromFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	if _, err := os.Stat(walletPath()); os.IsNotExist(err) {
 		return ws.SaveToFile()
 	}
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(walletPath())
 	if err != nil {
 		return err
 	}
-	var wallets Wallets
-	gob.Register(elliptic.P256())
-	err = gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&wallets)
+	if isEncryptedWallet(fileContent) {
+		if ws.passphrase == "" {
+			return ErrWalletLocked
+		}
+		if fileContent, err = decryptWallet(fileContent, ws.passphrase); err != nil {
+			return err
+		}
+	} else if ws.passphrase != "" {
+		return fmt.Errorf("%w, run encryptwallet to set a passphrase", ErrWalletNotEncrypted)
+	}
+
+	var data walletsData
+	err = gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&data)
 	if err != nil {
-		return err
+		if ws.IsEncrypted() {
+			return err
+		}
+		var legacyErr error
+		if data, legacyErr = decodeLegacyWallets(fileContent); legacyErr != nil {
+			return err
+		}
+	}
+	ws.seed = data.Seed
+	ws.nextIndex = data.NextIndex
+	for address, key := range data.Keys {
+		wallet, err := walletFromPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		ws.Wallets[address] = wallet
 	}
-	ws.Wallets = wallets.Wallets
-	return err
+	return nil
+}
+
+func decodeLegacyWallets(fileContent []byte) (walletsData, error) {
+	var legacy legacyWallets
+	if err := gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&legacy); err != nil {
+		return walletsData{}, err
+	}
+	data := walletsData{Keys: make(map[string][]byte)}
+	for address, wallet := range legacy.Wallets {
+		if wallet == nil || wallet.PrivateKey.D == nil {
+			return walletsData{}, ErrInvalidPrivateKey
+		}
+		data.Keys[address] = wallet.PrivateKey.D.Bytes()
+	}
+	return data, nil
 }
 
 func (ws Wallets) SaveToFile() error {
+	data := walletsData{Keys: make(map[string][]byte), Seed: ws.seed, NextIndex: ws.nextIndex}
+	for address, wallet := range ws.Wallets {
+		data.Keys[address] = wallet.PrivateKey.D.Bytes()
+	}
 	var content bytes.Buffer
-	gob.Register(elliptic.P256())
-	if err := gob.NewEncoder(&content).Encode(ws); err != nil {
+	if err := gob.NewEncoder(&content).Encode(data); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(walletFile, content.Bytes(), 0644); err != nil {
+	fileContent := content.Bytes()
+	if ws.IsEncrypted() {
+		var err error
+		if fileContent, err = encryptWallet(fileContent, ws.passphrase); err != nil {
+			return err
+		}
+	}
+	dir, err := networkDir()
+	if err != nil {
 		return err
 	}
-	return nil
+	// the keys are written to a temporary file replacing the wallet file
+	// once synced, so a crash never leaves a partially written wallet
+	tmp, err := ioutil.TempFile(dir, walletFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(fileContent); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, walletFile))
 }
@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"encoding/gob"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedWallets(t *testing.T) {
+	SetDataDir(t.TempDir())
+
+	wallets, err := GetWallets()
+	require.NoError(t, err)
+	address, err := wallets.CreateWallet()
+	require.NoError(t, err)
+	require.NoError(t, os.Chmod(walletPath(), 0644))
+	require.NoError(t, wallets.SaveToFile())
+	_, err = LoadWallets("secret")
+	require.ErrorIs(t, err, ErrWalletNotEncrypted)
+	require.NoError(t, wallets.Encrypt("secret"))
+	require.NoError(t, wallets.SaveToFile())
+	// saving replaces the file, leaving no temporary ones behind
+	files, err := ioutil.ReadDir(filepath.Dir(walletPath()))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	content, err := ioutil.ReadFile(walletPath())
+	require.NoError(t, err)
+	require.True(t, isEncryptedWallet(content))
+	info, err := os.Stat(walletPath())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = GetWallets()
+	require.ErrorIs(t, err, ErrWalletLocked)
+	_, err = LoadWallets("wrong")
+	require.ErrorIs(t, err, ErrWrongPassphrase)
+
+	loaded, err := LoadWallets("secret")
+	require.NoError(t, err)
+	wallet, err := loaded.GetWallet(address)
+	require.NoError(t, err)
+	require.Equal(t, wallets.Wallets[address].PublicKey, wallet.PublicKey)
+	require.Equal(t, 0, wallets.Wallets[address].PrivateKey.D.Cmp(wallet.PrivateKey.D))
+
+	require.ErrorIs(t, loaded.ChangePassphrase("wrong", "new"), ErrWrongPassphrase)
+	require.NoError(t, loaded.ChangePassphrase("secret", "new"))
+	require.NoError(t, loaded.SaveToFile())
+	_, err = LoadWallets("secret")
+	require.ErrorIs(t, err, ErrWrongPassphrase)
+	_, err = LoadWallets("new")
+	require.NoError(t, err)
+}
+
+func TestHDWallets(t *testing.T) {
+	SetDataDir(t.TempDir())
+	seed := []byte("0123456789abcdef0123456789abcdef")
+
+	wallets, err := GetWallets()
+	require.NoError(t, err)
+	require.NoError(t, wallets.InitHD(seed))
+	require.ErrorIs(t, wallets.InitHD(seed), ErrHDAlreadyInitialized)
+	first, err := wallets.CreateWallet()
+	require.NoError(t, err)
+	second, err := wallets.CreateWallet()
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	require.NoError(t, wallets.SaveToFile())
+
+	loaded, err := GetWallets()
+	require.NoError(t, err)
+	require.True(t, loaded.IsHD())
+	third, err := loaded.CreateWallet()
+	require.NoError(t, err)
+
+	other := &Wallets{Wallets: make(map[string]*Wallet)}
+	require.NoError(t, other.InitHD(seed))
+	for _, address := range []string{first, second, third} {
+		derived, err := other.CreateWallet()
+		require.NoError(t, err)
+		require.Equal(t, address, derived)
+	}
+}
+
+func TestRecoverHD(t *testing.T) {
+	bc, _, _ := newTestChain(t)
+	seed := []byte("0123456789abcdef0123456789abcdef")
+	wallets := &Wallets{Wallets: make(map[string]*Wallet)}
+	require.NoError(t, wallets.InitHD(seed))
+	var addresses []string
+	for i := 0; i < 4; i++ {
+		address, err := wallets.CreateWallet()
+		require.NoError(t, err)
+		addresses = append(addresses, address)
+	}
+	_, err := bc.Generate(context.Background(), 1, addresses[1])
+	require.NoError(t, err)
+
+	restored := &Wallets{Wallets: make(map[string]*Wallet)}
+	require.NoError(t, restored.InitHD(seed))
+	recovered, err := restored.RecoverHD(bc, 3)
+	require.NoError(t, err)
+	require.Equal(t, 1, recovered)
+	// the unused addresses up to the gap are restored too
+	require.Len(t, restored.Wallets, 5)
+	for _, address := range addresses {
+		require.Contains(t, restored.Wallets, address)
+	}
+	next, err := restored.CreateWallet()
+	require.NoError(t, err)
+	require.Len(t, restored.Wallets, 6)
+	require.NotContains(t, addresses, next)
+}
+
+// legacyCurve stands for the P-256 curve the way gob encoded it in the
+// plaintext wallet files written with the Wallets struct.
+type legacyCurve struct {
+	*elliptic.CurveParams
+}
+
+func TestLoadLegacyWallets(t *testing.T) {
+	SetDataDir(t.TempDir())
+	wallet, address := newTestAddress(t)
+
+	type legacyKey struct {
+		PublicKey struct {
+			elliptic.Curve
+			X, Y *big.Int
+		}
+		D *big.Int
+	}
+	type legacyWallet struct {
+		PrivateKey legacyKey
+		PublicKey  []byte
+	}
+	var key legacyKey
+	key.PublicKey.Curve = legacyCurve{elliptic.P256().Params()}
+	key.PublicKey.X, key.PublicKey.Y = wallet.PrivateKey.X, wallet.PrivateKey.Y
+	key.D = wallet.PrivateKey.D
+	gob.RegisterName("crypto/elliptic.p256Curve", legacyCurve{})
+	var content bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&content).Encode(struct {
+		Wallets map[string]*legacyWallet
+	}{map[string]*legacyWallet{address: {PrivateKey: key, PublicKey: wallet.PublicKey}}}))
+	_, err := networkDir()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(walletPath(), content.Bytes(), 0600))
+
+	wallets, err := GetWallets()
+	require.NoError(t, err)
+	loaded, err := wallets.GetWallet(address)
+	require.NoError(t, err)
+	require.Equal(t, wallet.PublicKey, loaded.PublicKey)
+
+	require.NoError(t, wallets.Encrypt("secret"))
+	require.NoError(t, wallets.SaveToFile())
+	encrypted, err := LoadWallets("secret")
+	require.NoError(t, err)
+	loaded, err = encrypted.GetWallet(address)
+	require.NoError(t, err)
+	require.Equal(t, 0, wallet.PrivateKey.D.Cmp(loaded.PrivateKey.D))
+}